@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+	"strconv"
+	"time"
 )
 
 const (
@@ -10,6 +12,30 @@ const (
 	redisAddr          = ":6379"         // Assumes running in Docker Compose network
 	redisPassword      = ""              // No password set
 	redisLuaScriptPath = "./lua_scripts" // Directory with Lua scripts
+
+	channelPolicyPath = "config/channel_policy.json" // Subscribe authorization rules
+
+	wsPingInterval = 30 * time.Second // How often clients are pinged
+	wsPingTimeout  = 10 * time.Second // Time allowed for a pong
+	wsIdleTimeout  = time.Duration(0) // Close connections sending no message for this long; 0 disables
+
+	wsSendQueueLimit  = 256           // Queued broadcast events per connection
+	wsSendQueuePolicy = "drop_oldest" // drop_oldest, drop_newest, coalesce or disconnect
+
+	wsMaxBatchSize   = 32              // Messages per batch or transaction
+	wsIdempotencyTTL = 5 * time.Minute // How long responses are kept for resent message IDs
+	wsResumeTTL      = 2 * time.Minute // How long a dropped session can be resumed
+
+	eventBacklogSize = 100              // Recent events kept per channel for replay
+	eventBacklogTTL  = 10 * time.Minute // Backlog of a quiet channel expires after this
+	eventStreams     = false            // Carry events on the backlog streams instead of Pub/Sub
+
+	lobbyTickScript = "" // Lua tick handler, e.g. "lobby_tick"; lobbies don't tick if empty
+	lobbyTickRate   = 20 // Ticks per second
+
+	redisFlushOnShutdown = false            // Never wipe shared Redis unless asked to
+	shutdownTimeout      = 10 * time.Second // Time allowed to drain WebSocket clients
+	reconnectAfter       = 2 * time.Second  // Reconnect hint sent to clients on shutdown
 )
 
 // Env holds all application-wide environment values.
@@ -19,6 +45,30 @@ var (
 	RedisAddr          string
 	RedisPassword      string
 	RedisLuaScriptPath string
+
+	ChannelPolicyPath string
+
+	WSPingInterval time.Duration
+	WSPingTimeout  time.Duration
+	WSIdleTimeout  time.Duration
+
+	WSSendQueueLimit  int
+	WSSendQueuePolicy string
+
+	WSMaxBatchSize   int
+	WSIdempotencyTTL time.Duration
+	WSResumeTTL      time.Duration
+
+	EventBacklogSize int
+	EventBacklogTTL  time.Duration
+	EventStreams     bool
+
+	LobbyTickScript string
+	LobbyTickRate   int
+
+	RedisFlushOnShutdown bool
+	ShutdownTimeout      time.Duration
+	ReconnectAfter       time.Duration
 )
 
 // LoadEnv reads env vars with defaults for all required configs.
@@ -28,6 +78,30 @@ func init() {
 	RedisAddr = getEnv("APP_REDIS_ADDR", redisAddr)
 	RedisPassword = getEnv("APP_REDIS_PASSWORD", redisPassword)
 	RedisLuaScriptPath = getEnv("APP_REDIS_LUA_SCRIPT_Path", redisLuaScriptPath)
+
+	ChannelPolicyPath = getEnv("APP_CHANNEL_POLICY_PATH", channelPolicyPath)
+
+	WSPingInterval = getEnvDuration("APP_WS_PING_INTERVAL", wsPingInterval)
+	WSPingTimeout = getEnvDuration("APP_WS_PING_TIMEOUT", wsPingTimeout)
+	WSIdleTimeout = getEnvDuration("APP_WS_IDLE_TIMEOUT", wsIdleTimeout)
+
+	WSSendQueueLimit = getEnvInt("APP_WS_SEND_QUEUE_LIMIT", wsSendQueueLimit)
+	WSSendQueuePolicy = getEnv("APP_WS_SEND_QUEUE_POLICY", wsSendQueuePolicy)
+
+	WSMaxBatchSize = getEnvInt("APP_WS_MAX_BATCH_SIZE", wsMaxBatchSize)
+	WSIdempotencyTTL = getEnvDuration("APP_WS_IDEMPOTENCY_TTL", wsIdempotencyTTL)
+	WSResumeTTL = getEnvDuration("APP_WS_RESUME_TTL", wsResumeTTL)
+
+	EventBacklogSize = getEnvInt("APP_EVENT_BACKLOG_SIZE", eventBacklogSize)
+	EventBacklogTTL = getEnvDuration("APP_EVENT_BACKLOG_TTL", eventBacklogTTL)
+	EventStreams = getEnvBool("APP_EVENT_STREAMS", eventStreams)
+
+	LobbyTickScript = getEnv("APP_LOBBY_TICK_SCRIPT", lobbyTickScript)
+	LobbyTickRate = getEnvInt("APP_LOBBY_TICK_RATE", lobbyTickRate)
+
+	RedisFlushOnShutdown = getEnvBool("APP_REDIS_FLUSH_ON_SHUTDOWN", redisFlushOnShutdown)
+	ShutdownTimeout = getEnvDuration("APP_SHUTDOWN_TIMEOUT", shutdownTimeout)
+	ReconnectAfter = getEnvDuration("APP_RECONNECT_AFTER", reconnectAfter)
 }
 
 // Helper: read env or fallback
@@ -37,3 +111,27 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// Helper: read a bool env var (e.g. "true", "1") or fallback
+func getEnvBool(key string, fallback bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// Helper: read an int env var or fallback
+func getEnvInt(key string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// Helper: read a duration env var (e.g. "10s", "500ms") or fallback
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return fallback
+}
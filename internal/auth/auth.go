@@ -9,6 +9,8 @@ import (
 	"strings"
 	"time"
 
+	"go-server/internal/server/errcode"
+
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/redis/go-redis/v9"
 )
@@ -37,24 +39,24 @@ type loginReq struct {
 func RegisterHandler(authProvider AuthProvider) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			errcode.WriteHTTP(w, http.StatusMethodNotAllowed, errcode.New(errcode.MethodNotAllowed, "Method not allowed"))
 			return
 		}
 
 		var req registerReq
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+			errcode.WriteHTTP(w, http.StatusBadRequest, errcode.New(errcode.InvalidRequest, "Invalid request"))
 			return
 		}
 
 		user, err := authProvider.Register(r.Context(), req.Username, req.Password)
 		if err != nil {
 			if err.Error() == "username already taken" {
-				http.Error(w, err.Error(), http.StatusConflict)
+				errcode.WriteHTTP(w, http.StatusConflict, errcode.New(errcode.UsernameTaken, err.Error()))
 			} else if strings.Contains(err.Error(), "required") || strings.Contains(err.Error(), "at least") {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				errcode.WriteHTTP(w, http.StatusBadRequest, errcode.New(errcode.InvalidArgs, err.Error()))
 			} else {
-				http.Error(w, "Internal error", http.StatusInternalServerError)
+				errcode.WriteHTTP(w, http.StatusInternalServerError, errcode.New(errcode.Internal, "Internal error"))
 			}
 			return
 		}
@@ -70,19 +72,19 @@ func RegisterHandler(authProvider AuthProvider) http.HandlerFunc {
 func LoginHandler(authProvider AuthProvider) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			errcode.WriteHTTP(w, http.StatusMethodNotAllowed, errcode.New(errcode.MethodNotAllowed, "Method not allowed"))
 			return
 		}
 
 		var req loginReq
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+			errcode.WriteHTTP(w, http.StatusBadRequest, errcode.New(errcode.InvalidRequest, "Invalid request"))
 			return
 		}
 
 		user, err := authProvider.Login(r.Context(), req.Username, req.Password)
 		if err != nil {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			errcode.WriteHTTP(w, http.StatusUnauthorized, errcode.New(errcode.InvalidCredentials, "Invalid credentials"))
 			return
 		}
 
@@ -91,13 +93,14 @@ func LoginHandler(authProvider AuthProvider) http.HandlerFunc {
 				"id":       user.ID,
 				"username": user.Username,
 				"is_guest": user.IsGuest,
+				"role":     user.Role,
 			},
 			"exp": time.Now().Add(24 * time.Hour).Unix(),
 		}
 		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 		signed, err := token.SignedString(jwtSecret)
 		if err != nil {
-			http.Error(w, "Internal error", http.StatusInternalServerError)
+			errcode.WriteHTTP(w, http.StatusInternalServerError, errcode.New(errcode.Internal, "Internal error"))
 			return
 		}
 
@@ -108,14 +111,14 @@ func LoginHandler(authProvider AuthProvider) http.HandlerFunc {
 func GuestHandler(redisClient *redis.Client) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			errcode.WriteHTTP(w, http.StatusMethodNotAllowed, errcode.New(errcode.MethodNotAllowed, "Method not allowed"))
 			return
 		}
 
 		ctx := r.Context()
 		guestID, err := redisClient.Incr(ctx, "guest_id_counter").Result()
 		if err != nil {
-			http.Error(w, "Internal error", http.StatusInternalServerError)
+			errcode.WriteHTTP(w, http.StatusInternalServerError, errcode.New(errcode.Internal, "Internal error"))
 			return
 		}
 		guestID = -guestID // Negative IDs for guests
@@ -126,7 +129,7 @@ func GuestHandler(redisClient *redis.Client) http.HandlerFunc {
 			"created_at": time.Now().Unix(),
 		}).Err()
 		if err != nil {
-			http.Error(w, "Internal error", http.StatusInternalServerError)
+			errcode.WriteHTTP(w, http.StatusInternalServerError, errcode.New(errcode.Internal, "Internal error"))
 			return
 		}
 		redisClient.Expire(ctx, guestKey, 1*time.Hour)
@@ -135,6 +138,7 @@ func GuestHandler(redisClient *redis.Client) http.HandlerFunc {
 			ID:       int(guestID),
 			Username: fmt.Sprintf("Guest_%d", -guestID),
 			IsGuest:  true,
+			Role:     RoleGuest,
 		}
 
 		claims := jwt.MapClaims{
@@ -142,13 +146,14 @@ func GuestHandler(redisClient *redis.Client) http.HandlerFunc {
 				"id":       user.ID,
 				"username": user.Username,
 				"is_guest": user.IsGuest,
+				"role":     user.Role,
 			},
 			"exp": time.Now().Add(1 * time.Hour).Unix(),
 		}
 		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 		signed, err := token.SignedString(jwtSecret)
 		if err != nil {
-			http.Error(w, "Internal error", http.StatusInternalServerError)
+			errcode.WriteHTTP(w, http.StatusInternalServerError, errcode.New(errcode.Internal, "Internal error"))
 			return
 		}
 
@@ -178,11 +183,18 @@ func ValidateJWT(tokenStr string, authProvider AuthProvider, redisClient *redis.
 	}
 	username, _ := userClaims["username"].(string) // Optional, may be empty
 	isGuest, _ := userClaims["is_guest"].(bool)
+	role, _ := userClaims["role"].(string) // Missing in tokens issued before roles existed
 
 	user := User{
 		ID:       int(userID),
 		Username: username,
 		IsGuest:  isGuest,
+		Role:     role,
+	}
+	if isGuest {
+		user.Role = RoleGuest
+	} else if user.Role == "" {
+		user.Role = RoleUser
 	}
 
 	if isGuest {
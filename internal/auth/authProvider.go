@@ -4,10 +4,28 @@ import (
 	"context"
 )
 
+// Roles carried in User.Role.
+const (
+	RoleGuest = "guest"
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
 	ID       int
 	Username string
 	IsGuest  bool
+	Role     string
+}
+
+// HasRole reports whether the user has one of the given roles.
+func (u User) HasRole(roles ...string) bool {
+	for _, r := range roles {
+		if u.Role == r {
+			return true
+		}
+	}
+	return false
 }
 
 type AuthProvider interface {
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -18,6 +19,7 @@ type SQLConfig struct {
 	IDColumn         string `json:"id_column"`
 	UsernameColumn   string `json:"username_column"`
 	PasswordColumn   string `json:"password_column"`
+	RoleColumn       string `json:"role_column,omitempty"` // optional, existing tables need the column added first; users default to "user"
 	CreateTableSQL   string `json:"create_table_sql"`
 	Dialect          string `json:"dialect"` // "sqlite", "postgres", "mysql"
 	ConnectionString string `json:"connection_string"`
@@ -118,25 +120,32 @@ func (s *SQLAuthProvider) Register(ctx context.Context, username, password strin
 		return User{}, fmt.Errorf("failed to insert user: %v", err)
 	}
 
-	return User{ID: id, Username: username, IsGuest: false}, nil
+	return User{ID: id, Username: username, IsGuest: false, Role: RoleUser}, nil
 }
 
 func (s *SQLAuthProvider) Login(ctx context.Context, username, password string) (User, error) {
 	var id int
 	var hash string
+	var role sql.NullString
 	var query string
+	columns := fmt.Sprintf("%s, %s", s.config.IDColumn, s.config.PasswordColumn)
+	dest := []interface{}{&id, &hash}
+	if s.config.RoleColumn != "" {
+		columns += ", " + s.config.RoleColumn
+		dest = append(dest, &role)
+	}
 	if s.config.Dialect == "postgres" {
 		// PostgreSQL: Case-sensitive comparison
-		query = fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s = $1", s.config.IDColumn, s.config.PasswordColumn, s.config.TableName, s.config.UsernameColumn)
-		err := s.db.QueryRowContext(ctx, query, username).Scan(&id, &hash)
+		query = fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", columns, s.config.TableName, s.config.UsernameColumn)
+		err := s.db.QueryRowContext(ctx, query, username).Scan(dest...)
 		if err != nil {
 			return User{}, fmt.Errorf("invalid credentials")
 		}
 	} else {
 		log.Println("sqlite login")
 		// SQLite, MySQL: Case-insensitive comparison
-		query = fmt.Sprintf("SELECT %s, %s FROM %s WHERE LOWER(%s) = LOWER(?)", s.config.IDColumn, s.config.PasswordColumn, s.config.TableName, s.config.UsernameColumn)
-		err := s.db.QueryRowContext(ctx, query, username).Scan(&id, &hash)
+		query = fmt.Sprintf("SELECT %s FROM %s WHERE LOWER(%s) = LOWER(?)", columns, s.config.TableName, s.config.UsernameColumn)
+		err := s.db.QueryRowContext(ctx, query, username).Scan(dest...)
 		if err != nil {
 			log.Println("sqlite login error", err)
 			return User{}, fmt.Errorf("invalid credentials")
@@ -146,7 +155,10 @@ func (s *SQLAuthProvider) Login(ctx context.Context, username, password string)
 	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
 		return User{}, fmt.Errorf("invalid credentials")
 	}
-	return User{ID: id, Username: username, IsGuest: false}, nil
+	if !role.Valid || role.String == "" {
+		role.String = RoleUser
+	}
+	return User{ID: id, Username: username, IsGuest: false, Role: role.String}, nil
 }
 
 func (s *SQLAuthProvider) ValidateUser(ctx context.Context, userID int) (bool, error) {
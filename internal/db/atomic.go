@@ -0,0 +1,218 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ScriptCall is one script invocation run by CallScriptsAtomic.
+type ScriptCall struct {
+	Script string
+	Keys   []string
+	Args   []interface{}
+}
+
+// StepError is returned by CallScriptsAtomic when one of the calls fails.
+// Err is a *ScriptError when the script itself reported the failure.
+type StepError struct {
+	Step int // index of the failed call
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("step %d: %v", e.Step+1, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// CallScriptsAtomic runs calls in order in a single Lua script, so no other
+// Redis command runs in between. Each script sees only its own KEYS and
+// ARGV. Events the scripts PUBLISH are held back until every call
+// succeeded. If a call fails, every key passed to any of the calls is
+// restored to its state before the first call, nothing is published and a
+// *StepError is returned; scripts must therefore only write the keys they
+// are passed. On success the decoded reply of each call is returned.
+//
+// The calls run through one fixed dispatcher script that gets the sources
+// of the scripts, behind scriptLib, in ARGV, so any mix of scripts shares
+// one entry in the Redis script cache.
+func (db *RedisManager) CallScriptsAtomic(ctx context.Context, calls []ScriptCall) ([]map[string]interface{}, error) {
+	if len(calls) == 0 {
+		return nil, errors.New("no script calls")
+	}
+
+	layout := make([][5]int, len(calls))
+	var keys []string
+	args := []interface{}{""}   // ARGV[1] is the layout, set below
+	sources := map[string]int{} // script -> ARGV index of its source
+	db.mu.RLock()
+	for i, call := range calls {
+		script, ok := db.scripts[call.Script]
+		if !ok {
+			db.mu.RUnlock()
+			return nil, fmt.Errorf("script %s not loaded", call.Script)
+		}
+		src, ok := sources[call.Script]
+		if !ok {
+			args = append(args, oneLine(scriptLib)+" "+script.src)
+			src = len(args)
+			sources[call.Script] = src
+		}
+		layout[i] = [5]int{len(keys) + 1, len(call.Keys), len(args) + 1, len(call.Args), src}
+		keys = append(keys, call.Keys...)
+		args = append(args, call.Args...)
+	}
+	db.mu.RUnlock()
+
+	layoutJSON, err := json.Marshal(layout)
+	if err != nil {
+		return nil, err
+	}
+	args[0] = string(layoutJSON)
+
+	res, err := db.atomic.Run(ctx, db.Client, keys, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	str, _ := res.(string)
+	var reply struct {
+		Status  string        `json:"status"`
+		Step    int           `json:"step"`
+		Code    string        `json:"code"`
+		Err     string        `json:"err"`
+		Details interface{}   `json:"details"`
+		Results []interface{} `json:"results"`
+	}
+	if err := json.Unmarshal([]byte(str), &reply); err != nil {
+		return nil, fmt.Errorf("decode atomic reply: %w", err)
+	}
+
+	if reply.Status == "error" {
+		step := reply.Step - 1
+		if step < 0 || step >= len(calls) {
+			return nil, fmt.Errorf("atomic call failed: %s", reply.Err)
+		}
+		msg := reply.Err
+		if msg == "" {
+			msg = "script error"
+		}
+		return nil, &StepError{Step: step, Err: &ScriptError{Script: calls[step].Script, Code: reply.Code, Message: msg, Details: reply.Details}}
+	}
+
+	results := make([]map[string]interface{}, len(calls))
+	for i, call := range calls {
+		var r interface{}
+		if i < len(reply.Results) {
+			r = reply.Results[i]
+		}
+		if results[i], err = decodeScriptResult(call.Script, r); err != nil {
+			return nil, &StepError{Step: i, Err: err}
+		}
+	}
+	return results, nil
+}
+
+// atomicPrelude sets up the proxy passed to every step as `redis`: it
+// buffers PUBLISH until the whole call succeeded and forwards everything
+// else to the real redis object. It follows publishFunc, which the runner
+// uses to publish the buffered events.
+const atomicPrelude = `
+local real = redis
+local pending = {}
+local proxy = setmetatable({}, {__index = real})
+local function buffered(call)
+    return function(cmd, ...)
+        if string.upper(cmd) == "PUBLISH" then
+            pending[#pending + 1] = {...}
+            return 0
+        end
+        return call(cmd, ...)
+    end
+end
+proxy.call = buffered(real.call)
+proxy.pcall = buffered(real.pcall)
+
+`
+
+// atomicRunner snapshots every key with DUMP, runs the steps and restores
+// the snapshots if one of them fails. ARGV[1] holds, for each step, the
+// first index and count of its KEYS and of its ARGV, and the index of the
+// ARGV holding its script's source.
+const atomicRunner = `
+local layout = cjson.decode(ARGV[1])
+
+-- A step gets its KEYS, ARGV and the proxy as the chunk's varargs. The
+-- header shares the first line so error line numbers match the file.
+local compiled = {}
+local function compile(src)
+    if compiled[src] == nil then
+        local fn, err = loadstring("local KEYS, ARGV, redis = ... " .. ARGV[src])
+        compiled[src] = fn or err
+    end
+    return compiled[src]
+end
+
+local snapshot = {}
+for _, key in ipairs(KEYS) do
+    if snapshot[key] == nil then
+        snapshot[key] = {real.call("DUMP", key), real.call("PTTL", key)}
+    end
+end
+
+local function rollback()
+    for key, snap in pairs(snapshot) do
+        if snap[1] then
+            local ttl = snap[2] > 0 and snap[2] or 0
+            real.call("RESTORE", key, ttl, snap[1], "REPLACE")
+        else
+            real.call("DEL", key)
+        end
+    end
+end
+
+local function slice(list, first, count)
+    local out = {}
+    for i = 1, count do
+        out[i] = list[first + i - 1]
+    end
+    return out
+end
+
+local results = {}
+for i, l in ipairs(layout) do
+    local step = compile(l[5])
+    local ok, res
+    if type(step) == "function" then
+        ok, res = pcall(step, slice(KEYS, l[1], l[2]), slice(ARGV, l[3], l[4]), proxy)
+    else
+        ok, res = false, step
+    end
+    local failure
+    if not ok then
+        local msg = type(res) == "table" and res.err or tostring(res)
+        failure = {code = "script_error", err = msg}
+    elseif type(res) == "string" then
+        local decoded, obj = pcall(cjson.decode, res)
+        if decoded and type(obj) == "table" and (obj.status == "error" or obj.err) then
+            failure = {code = obj.code, err = obj.err or obj.message, details = obj.details}
+        end
+    end
+    if failure then
+        rollback()
+        return cjson.encode({status = "error", step = i, code = failure.code, err = failure.err, details = failure.details})
+    end
+    if res == nil then
+        res = cjson.null
+    end
+    results[i] = res
+end
+
+for _, args in ipairs(pending) do
+    publish_event(real.call, unpack(args))
+end
+return cjson.encode({status = "ok", results = results})
+`
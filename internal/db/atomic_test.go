@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testScripts are loaded by newTestRedis. Those run atomically write
+// their KEYS[1] before they succeed or fail, so rollbacks show.
+var testScripts = map[string]string{
+	"set": `redis.call("SET", KEYS[1], ARGV[1])
+redis.call("PUBLISH", "ch", cjson.encode({type = "set", value = ARGV[1]}))
+return cjson.encode({status = "ok", key = KEYS[1], value = ARGV[1], nargs = #ARGV})`,
+	"fail": `redis.call("SET", KEYS[1], "dirty")
+return cjson.encode({status = "error", code = "nope", err = "failed", details = {why = "test"}})`,
+	"boom": `redis.call("SET", KEYS[1], "dirty")
+error("boom")`,
+	"roundtrip": `return cjson.encode({status = "ok", json = encode(decode(ARGV[1]))})`,
+}
+
+func newTestRedis(t *testing.T, backlog EventBacklog) (*miniredis.Miniredis, *RedisManager) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range testScripts {
+		if err := os.WriteFile(filepath.Join(dir, name+".lua"), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mr := miniredis.RunT(t)
+	rm, err := InitRedis(mr.Addr(), "", dir, backlog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rm.Client.Close() })
+	return mr, rm
+}
+
+func TestCallScriptsAtomic(t *testing.T) {
+	tests := []struct {
+		name   string
+		calls  []ScriptCall
+		step   int    // failed step, or -1
+		code   string // of the failed step
+		a, b   string // values afterwards
+		events int
+	}{
+		{"all succeed", []ScriptCall{
+			{Script: "set", Keys: []string{"a"}, Args: []interface{}{"1"}},
+			{Script: "set", Keys: []string{"b"}, Args: []interface{}{"2", "extra"}},
+		}, -1, "", "1", "2", 2},
+		{"same key twice", []ScriptCall{
+			{Script: "set", Keys: []string{"a"}, Args: []interface{}{"1"}},
+			{Script: "set", Keys: []string{"a"}, Args: []interface{}{"2"}},
+		}, -1, "", "2", "", 2},
+		{"script error", []ScriptCall{
+			{Script: "set", Keys: []string{"a"}, Args: []interface{}{"1"}},
+			{Script: "fail", Keys: []string{"b"}},
+		}, 1, "nope", "old", "", 0},
+		{"lua error", []ScriptCall{
+			{Script: "set", Keys: []string{"a"}, Args: []interface{}{"1"}},
+			{Script: "set", Keys: []string{"b"}, Args: []interface{}{"2"}},
+			{Script: "boom", Keys: []string{"c"}},
+		}, 2, "script_error", "old", "", 0},
+		{"first step fails", []ScriptCall{
+			{Script: "fail", Keys: []string{"a"}},
+			{Script: "set", Keys: []string{"b"}, Args: []interface{}{"2"}},
+		}, 0, "nope", "old", "", 0},
+	}
+	for _, tt := range tests {
+		mr, rm := newTestRedis(t, EventBacklog{Size: 10, TTL: time.Minute})
+		mr.Set("a", "old")
+		mr.SetTTL("a", time.Hour)
+
+		results, err := rm.CallScriptsAtomic(context.Background(), tt.calls)
+		if tt.step < 0 {
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			for i, res := range results {
+				call := tt.calls[i]
+				want := map[string]interface{}{"status": "ok", "key": call.Keys[0], "value": call.Args[0], "nargs": float64(len(call.Args))}
+				if !reflect.DeepEqual(res, want) {
+					t.Errorf("%s: result %d = %v, want %v", tt.name, i, res, want)
+				}
+			}
+		} else {
+			var stepErr *StepError
+			var scriptErr *ScriptError
+			if !errors.As(err, &stepErr) || !errors.As(err, &scriptErr) {
+				t.Fatalf("%s: error = %v, want a *StepError", tt.name, err)
+			}
+			if stepErr.Step != tt.step || scriptErr.Code != tt.code || scriptErr.Script != tt.calls[tt.step].Script {
+				t.Errorf("%s: error = %+v (%+v), want step %d with %s", tt.name, stepErr, scriptErr, tt.step, tt.code)
+			}
+			if tt.code == "nope" && !reflect.DeepEqual(scriptErr.Details, map[string]interface{}{"why": "test"}) {
+				t.Errorf("%s: details = %v", tt.name, scriptErr.Details)
+			}
+		}
+
+		for key, want := range map[string]string{"a": tt.a, "b": tt.b, "c": ""} {
+			got, _ := mr.Get(key)
+			if got != want {
+				t.Errorf("%s: %s = %q, want %q", tt.name, key, got, want)
+			}
+		}
+		if tt.a == "old" && mr.TTL("a") <= 0 {
+			t.Errorf("%s: a lost its TTL", tt.name)
+		}
+		events, err := rm.EventsSince(context.Background(), "ch", "0", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != tt.events {
+			t.Errorf("%s: %d events published, want %d", tt.name, len(events), tt.events)
+		}
+	}
+}
+
+func TestCallScriptsAtomicUnknownScript(t *testing.T) {
+	_, rm := newTestRedis(t, EventBacklog{})
+	_, err := rm.CallScriptsAtomic(context.Background(), []ScriptCall{{Script: "missing"}})
+	if err == nil {
+		t.Error("unknown script succeeded")
+	}
+	if _, err := rm.CallScriptsAtomic(context.Background(), nil); err == nil {
+		t.Error("empty call list succeeded")
+	}
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// EventBacklog configures the per-channel event backlog. Every JSON object
+// a script PUBLISHes is also appended to the Redis stream BacklogKey(channel),
+// capped at about Size entries and expiring TTL after the last event. The
+// published copy carries the stream entry ID as "seq", which clients use to
+// ask for the events they missed. A Size of 0 or less disables the backlog,
+// unless Streams is set.
+type EventBacklog struct {
+	Size int
+	TTL  time.Duration
+
+	// Streams makes the streams the only event transport: PUBLISH in a
+	// script appends every message to the stream and publishes nothing, and
+	// servers read the streams instead of subscribing. The streams then
+	// double as an event log; a Size or TTL of 0 keeps events forever.
+	Streams bool
+}
+
+func (b EventBacklog) enabled() bool {
+	return b.Size > 0 || b.Streams
+}
+
+// Streams reports whether events are carried by streams rather than Pub/Sub.
+func (db *RedisManager) Streams() bool {
+	return db.backlog.Streams
+}
+
+// HasBacklog reports whether script events are recorded in streams.
+func (db *RedisManager) HasBacklog() bool {
+	return db.backlog.enabled()
+}
+
+// BacklogKey returns the stream holding the recent events of channel.
+func BacklogKey(channel string) string {
+	return channel + ":backlog"
+}
+
+// BacklogEvent is an event read back from a channel's backlog.
+type BacklogEvent struct {
+	Seq  string // stream entry ID
+	Data string // the event JSON as published, without seq
+}
+
+// EventsSince returns up to count events of channel published after seq,
+// oldest first. seq "0" returns the whole backlog.
+func (db *RedisManager) EventsSince(ctx context.Context, channel, seq string, count int64) ([]BacklogEvent, error) {
+	msgs, err := db.Client.XRangeN(ctx, BacklogKey(channel), "("+seq, "+", count).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	events := make([]BacklogEvent, 0, len(msgs))
+	for _, msg := range msgs {
+		data, _ := msg.Values["event"].(string)
+		events = append(events, BacklogEvent{Seq: msg.ID, Data: data})
+	}
+	return events, nil
+}
+
+// LastEventID returns the seq of the newest event of channel, or "0-0" if
+// there is none. Events after it can be read with EventsSince.
+func (db *RedisManager) LastEventID(ctx context.Context, channel string) (string, error) {
+	msgs, err := db.Client.XRevRangeN(ctx, BacklogKey(channel), "+", "-", 1).Result()
+	if err != nil && err != redis.Nil {
+		return "", err
+	}
+	if len(msgs) == 0 {
+		return "0-0", nil
+	}
+	return msgs[0].ID, nil
+}
+
+// ReadEvents waits up to block for events published after since[channel] on
+// any of the channels and returns up to count of them per channel. It
+// returns no events, and no error, if none arrived in time.
+func (db *RedisManager) ReadEvents(ctx context.Context, since map[string]string, count int64, block time.Duration) (map[string][]BacklogEvent, error) {
+	streams := make([]string, 0, 2*len(since))
+	ids := make([]string, 0, len(since))
+	channels := make(map[string]string, len(since)) // stream -> channel
+	for channel, id := range since {
+		streams = append(streams, BacklogKey(channel))
+		ids = append(ids, id)
+		channels[BacklogKey(channel)] = channel
+	}
+	streams = append(streams, ids...)
+
+	res, err := db.Client.XRead(ctx, &redis.XReadArgs{Streams: streams, Count: count, Block: block}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	events := make(map[string][]BacklogEvent, len(res))
+	for _, stream := range res {
+		channel := channels[stream.Stream]
+		for _, msg := range stream.Messages {
+			data, _ := msg.Values["event"].(string)
+			events[channel] = append(events[channel], BacklogEvent{Seq: msg.ID, Data: data})
+		}
+	}
+	return events, nil
+}
+
+// PublishEvent publishes msg on channel from Go the way a script's PUBLISH
+// does, so the event gets a seq and is recorded in the backlog or carried
+// by the streams like every other event.
+func (db *RedisManager) PublishEvent(ctx context.Context, channel string, msg []byte) error {
+	return db.publisher.Run(ctx, db.Client, []string{BacklogKey(channel)}, channel, msg).Err()
+}
+
+// publishFunc returns the Lua source of publish_event(call, channel, msg),
+// which publishes msg and, with the backlog enabled, records it first.
+// Arrays and non-JSON messages are published as they are. In Streams mode
+// it only records msg, whatever it is.
+func (db *RedisManager) publishFunc() string {
+	switch {
+	case db.backlog.Streams:
+		return fmt.Sprintf(`local function publish_event(call, channel, msg)
+    local stream = channel .. %q
+    %s
+    return 0
+end
+`, BacklogKey(""), db.appendFunc())
+	case db.backlog.Size > 0:
+		return fmt.Sprintf(`local function publish_event(call, channel, msg)
+    local ok, evt = pcall(cjson.decode, msg)
+    if not ok or type(evt) ~= "table" or evt[1] ~= nil then
+        return call("PUBLISH", channel, msg)
+    end
+    local stream = channel .. %q
+    %s
+    evt.seq = seq
+    return call("PUBLISH", channel, cjson.encode(evt))
+end
+`, BacklogKey(""), db.appendFunc())
+	}
+	return `local function publish_event(call, channel, msg)
+    return call("PUBLISH", channel, msg)
+end
+`
+}
+
+// appendFunc returns the Lua that adds msg to stream as seq, trimmed to Size
+// and expiring after TTL when they are set.
+func (db *RedisManager) appendFunc() string {
+	trim := ""
+	if db.backlog.Size > 0 {
+		trim = fmt.Sprintf(`"MAXLEN", "~", %d, `, db.backlog.Size)
+	}
+	src := fmt.Sprintf(`local seq = call("XADD", stream, %s"*", "event", msg)`, trim)
+	if ttl := db.backlog.TTL.Milliseconds(); ttl > 0 {
+		src += fmt.Sprintf("\n    call(\"PEXPIRE\", stream, %d)", ttl)
+	}
+	return src
+}
+
+// wrapScript returns the source loaded into Redis for a script file: src
+// behind scriptLib and, with the backlog enabled, behind a proxy shadowing
+// `redis` whose PUBLISH goes through publish_event. The preludes are joined
+// into one line in front of the first line of src, so line numbers in
+// Redis errors still match the file.
+func (db *RedisManager) wrapScript(src string) string {
+	prelude := scriptLib
+	if db.backlog.enabled() {
+		prelude += db.publishFunc() + `local redis = (function(real)
+    local proxy = setmetatable({}, {__index = real})
+    local function intercept(call)
+        return function(cmd, ...)
+            if string.upper(cmd) == "PUBLISH" then
+                return publish_event(call, ...)
+            end
+            return call(cmd, ...)
+        end
+    end
+    proxy.call = intercept(real.call)
+    proxy.pcall = intercept(real.pcall)
+    return proxy
+end)(redis)
+`
+	}
+	return oneLine(prelude) + " " + src
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go-server/internal/auth"
+)
+
+// ScriptManifest declares how clients may call a Lua script. It is read
+// either from a "<name>.manifest.json" file next to the script or from a
+// header comment in the script itself:
+//
+//	-- manifest:
+//	-- {
+//	--   "access": "client",
+//	--   "args": [{"name": "lobby_id", "type": "string"}],
+//	--   "keys": ["lobby:{lobby_id}"],
+//	--   "argv": ["{lobby_id}", "{player_id}"]
+//	-- }
+//
+// Scripts without a manifest are internal-only: Go code may call them with
+// CallScript, clients may not.
+type ScriptManifest struct {
+	Access string    `json:"access"`         // "client" or "internal"
+	Role   string    `json:"role,omitempty"` // required auth role; empty allows everyone
+	Args   []ArgSpec `json:"args"`           // client arguments, in order
+	Keys   []string  `json:"keys"`           // KEYS templates
+	Argv   []string  `json:"argv,omitempty"` // ARGV templates; defaults to the client arguments
+}
+
+// ArgSpec describes one client argument.
+type ArgSpec struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`               // string, number, integer, bool or json
+	Optional bool   `json:"optional,omitempty"` // may be left out or null; passed as ""
+}
+
+const (
+	AccessClient   = "client"
+	AccessInternal = "internal"
+)
+
+// Template variables filled in by the server rather than the client.
+var serverVars = map[string]bool{
+	"player_id": true, // auth.User.Username
+	"user_id":   true, // auth.User.ID
+}
+
+var templateVar = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
+
+// parseManifest returns the manifest in the sidecar file if it exists,
+// otherwise the one in the script header, or nil if there is none.
+func parseManifest(scriptPath string, src string) (*ScriptManifest, error) {
+	var raw string
+	if data, err := os.ReadFile(manifestPath(scriptPath)); err == nil {
+		raw = string(data)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if raw = headerManifest(src); raw == "" {
+		return nil, nil
+	}
+
+	var m ScriptManifest
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	return &m, nil
+}
+
+func manifestPath(scriptPath string) string {
+	return strings.TrimSuffix(scriptPath, ".lua") + ".manifest.json"
+}
+
+// headerManifest extracts the JSON following a "-- manifest:" line, up to
+// the first line that is not a comment.
+func headerManifest(src string) string {
+	var b strings.Builder
+	inManifest := false
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "--") {
+			if inManifest {
+				break
+			}
+			continue
+		}
+		text := strings.TrimSpace(strings.TrimPrefix(line, "--"))
+		if !inManifest {
+			inManifest = text == "manifest:"
+			continue
+		}
+		b.WriteString(text)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func (m *ScriptManifest) validate() error {
+	if m.Access != AccessClient && m.Access != AccessInternal {
+		return fmt.Errorf("access must be %q or %q", AccessClient, AccessInternal)
+	}
+	known := make(map[string]bool)
+	for i, a := range m.Args {
+		switch a.Type {
+		case "string", "number", "integer", "bool", "json":
+		default:
+			return fmt.Errorf("arg %s: unknown type %q", a.Name, a.Type)
+		}
+		if a.Name == "" || serverVars[a.Name] || known[a.Name] {
+			return fmt.Errorf("arg %d: name %q is empty, reserved or duplicated", i, a.Name)
+		}
+		if i > 0 && m.Args[i-1].Optional && !a.Optional {
+			return fmt.Errorf("arg %s: required args must come before optional ones", a.Name)
+		}
+		known[a.Name] = true
+	}
+	for _, tmpl := range append(append([]string{}, m.Keys...), m.Argv...) {
+		for _, match := range templateVar.FindAllStringSubmatch(tmpl, -1) {
+			if !known[match[1]] && !serverVars[match[1]] {
+				return fmt.Errorf("template %q uses unknown variable %s", tmpl, match[1])
+			}
+		}
+	}
+	return nil
+}
+
+// bind checks the client's args against the manifest and returns the
+// KEYS and ARGV to call the script with.
+func (m *ScriptManifest) bind(script string, user auth.User, args []interface{}) ([]string, []interface{}, error) {
+	reject := func(code, format string, a ...interface{}) error {
+		return &ScriptError{Script: script, Code: code, Message: fmt.Sprintf(format, a...)}
+	}
+
+	if m.Access != AccessClient {
+		return nil, nil, reject("script_not_callable", "%s cannot be called by clients", script)
+	}
+	if m.Role != "" && !user.HasRole(m.Role, auth.RoleAdmin) {
+		return nil, nil, reject("forbidden", "%s requires role %s", script, m.Role)
+	}
+	if len(args) > len(m.Args) {
+		return nil, nil, reject("invalid_args", "%s takes at most %d args", script, len(m.Args))
+	}
+
+	vars := map[string]string{
+		"player_id": user.Username,
+		"user_id":   strconv.Itoa(user.ID),
+	}
+	values := make([]interface{}, 0, len(m.Args))
+	for i, spec := range m.Args {
+		if i >= len(args) {
+			if !spec.Optional {
+				return nil, nil, reject("missing_args", "%s requires %s", script, spec.Name)
+			}
+			vars[spec.Name] = ""
+			continue
+		}
+		if args[i] == nil && spec.Optional {
+			// null skips an optional arg in front of the next one.
+			vars[spec.Name] = ""
+			values = append(values, "")
+			continue
+		}
+		s, err := argString(spec.Type, args[i])
+		if err != nil {
+			return nil, nil, reject("invalid_args", "%s: %v", spec.Name, err)
+		}
+		vars[spec.Name] = s
+		values = append(values, s)
+	}
+
+	keys := make([]string, len(m.Keys))
+	for i, tmpl := range m.Keys {
+		key, err := fillTemplate(tmpl, vars, true)
+		if err != nil {
+			return nil, nil, reject("invalid_keys", "%v", err)
+		}
+		keys[i] = key
+	}
+
+	if m.Argv == nil {
+		return keys, values, nil
+	}
+	argv := make([]interface{}, len(m.Argv))
+	for i, tmpl := range m.Argv {
+		arg, _ := fillTemplate(tmpl, vars, false)
+		argv[i] = arg
+	}
+	return keys, argv, nil
+}
+
+// argString checks v against typ and converts it to the string passed to Lua.
+func argString(typ string, v interface{}) (string, error) {
+	switch typ {
+	case "string":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case "number":
+		if f, ok := v.(float64); ok {
+			return strconv.FormatFloat(f, 'f', -1, 64), nil
+		}
+	case "integer":
+		if f, ok := v.(float64); ok && f == math.Trunc(f) {
+			return strconv.FormatInt(int64(f), 10), nil
+		}
+	case "bool":
+		if b, ok := v.(bool); ok {
+			return strconv.FormatBool(b), nil
+		}
+	case "json":
+		if s, ok := v.(string); ok && json.Valid([]byte(s)) {
+			return s, nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	return "", fmt.Errorf("expected %s", typ)
+}
+
+// fillTemplate replaces {name} with vars[name]. Values used in keys must be
+// non-empty and free of ':' so a client cannot reach outside the key's
+// namespace.
+func fillTemplate(tmpl string, vars map[string]string, isKey bool) (string, error) {
+	var err error
+	out := templateVar.ReplaceAllStringFunc(tmpl, func(match string) string {
+		v := vars[match[1:len(match)-1]]
+		if isKey && (v == "" || strings.ContainsAny(v, ":{}")) {
+			err = fmt.Errorf("invalid value %q for %s", v, match)
+		}
+		return v
+	})
+	return out, err
+}
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go-server/internal/auth"
+)
+
+func TestFillTemplate(t *testing.T) {
+	vars := map[string]string{"lobby_id": "abc", "player_id": "alice", "empty": "", "evil": "abc:players", "brace": "{x}"}
+	tests := []struct {
+		tmpl  string
+		isKey bool
+		want  string
+		ok    bool
+	}{
+		{"lobby:{lobby_id}", true, "lobby:abc", true},
+		{"lobby:{lobby_id}:{player_id}", true, "lobby:abc:alice", true},
+		{"lobby:{evil}", true, "", false},
+		{"lobby:{brace}", true, "", false},
+		{"lobby:{empty}", true, "", false},
+		{"lobby:{missing}", true, "", false},
+		{"fixed", true, "fixed", true},
+		// ARGV values may hold anything.
+		{"{evil}", false, "abc:players", true},
+		{"{empty}", false, "", true},
+	}
+	for _, tt := range tests {
+		got, err := fillTemplate(tt.tmpl, vars, tt.isKey)
+		if (err == nil) != tt.ok {
+			t.Errorf("fillTemplate(%q, %v) error = %v, want ok %v", tt.tmpl, tt.isKey, err, tt.ok)
+			continue
+		}
+		if tt.ok && got != tt.want {
+			t.Errorf("fillTemplate(%q, %v) = %q, want %q", tt.tmpl, tt.isKey, got, tt.want)
+		}
+	}
+}
+
+func TestManifestBind(t *testing.T) {
+	m := &ScriptManifest{
+		Access: AccessClient,
+		Args: []ArgSpec{
+			{Name: "lobby_id", Type: "string"},
+			{Name: "state", Type: "json"},
+			{Name: "version", Type: "integer", Optional: true},
+			{Name: "mode", Type: "string", Optional: true},
+		},
+		Keys: []string{"lobby:{lobby_id}", "lobby:{lobby_id}:players"},
+		Argv: []string{"{lobby_id}", "{player_id}", "{state}", "{version}", "{mode}"},
+	}
+	if err := m.validate(); err != nil {
+		t.Fatal(err)
+	}
+	alice := auth.User{ID: 7, Username: "alice", Role: auth.RoleUser}
+
+	tests := []struct {
+		name string
+		args []interface{}
+		keys []string
+		argv []interface{}
+		code string
+	}{
+		{
+			name: "required only",
+			args: []interface{}{"abc", map[string]interface{}{"x": 1.0}},
+			keys: []string{"lobby:abc", "lobby:abc:players"},
+			argv: []interface{}{"abc", "alice", `{"x":1}`, "", ""},
+		},
+		{
+			name: "json string passed as is",
+			args: []interface{}{"abc", `{"x": 1}`, 3.0, "merge"},
+			keys: []string{"lobby:abc", "lobby:abc:players"},
+			argv: []interface{}{"abc", "alice", `{"x": 1}`, "3", "merge"},
+		},
+		{
+			name: "null skips an optional arg",
+			args: []interface{}{"abc", "{}", nil, "set"},
+			keys: []string{"lobby:abc", "lobby:abc:players"},
+			argv: []interface{}{"abc", "alice", "{}", "", "set"},
+		},
+		{name: "key injection", args: []interface{}{"abc:players", "{}"}, code: "invalid_keys"},
+		{name: "template injection", args: []interface{}{"{player_id}", "{}"}, code: "invalid_keys"},
+		{name: "empty key segment", args: []interface{}{"", "{}"}, code: "invalid_keys"},
+		{name: "missing arg", args: []interface{}{"abc"}, code: "missing_args"},
+		{name: "null required arg", args: []interface{}{nil, "{}"}, code: "invalid_args"},
+		{name: "too many args", args: []interface{}{"abc", "{}", 1.0, "merge", "x"}, code: "invalid_args"},
+		{name: "wrong type", args: []interface{}{1.0, "{}"}, code: "invalid_args"},
+		{name: "fractional integer", args: []interface{}{"abc", "{}", 1.5}, code: "invalid_args"},
+	}
+	for _, tt := range tests {
+		keys, argv, err := m.bind("update_state", alice, tt.args)
+		if tt.code != "" {
+			var scriptErr *ScriptError
+			if !errors.As(err, &scriptErr) || scriptErr.Code != tt.code {
+				t.Errorf("%s: error = %v, want %s", tt.name, err, tt.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(keys, tt.keys) || !reflect.DeepEqual(argv, tt.argv) {
+			t.Errorf("%s: got %q %q, want %q %q", tt.name, keys, argv, tt.keys, tt.argv)
+		}
+	}
+}
+
+func TestManifestBindAccess(t *testing.T) {
+	user := auth.User{ID: 1, Username: "alice", Role: auth.RoleUser}
+	admin := auth.User{ID: 2, Username: "root", Role: auth.RoleAdmin}
+	moderator := auth.User{ID: 3, Username: "mod", Role: "moderator"}
+
+	tests := []struct {
+		name     string
+		manifest ScriptManifest
+		user     auth.User
+		code     string
+	}{
+		{"internal", ScriptManifest{Access: AccessInternal}, admin, "script_not_callable"},
+		{"client", ScriptManifest{Access: AccessClient}, user, ""},
+		{"role missing", ScriptManifest{Access: AccessClient, Role: "moderator"}, user, "forbidden"},
+		{"role held", ScriptManifest{Access: AccessClient, Role: "moderator"}, moderator, ""},
+		{"admin passes role checks", ScriptManifest{Access: AccessClient, Role: "moderator"}, admin, ""},
+	}
+	for _, tt := range tests {
+		_, _, err := tt.manifest.bind("script", tt.user, nil)
+		var scriptErr *ScriptError
+		switch {
+		case tt.code == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.code != "" && (!errors.As(err, &scriptErr) || scriptErr.Code != tt.code):
+			t.Errorf("%s: error = %v, want %s", tt.name, err, tt.code)
+		}
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	str := func(name string) ArgSpec { return ArgSpec{Name: name, Type: "string"} }
+	tests := []struct {
+		name     string
+		manifest ScriptManifest
+		ok       bool
+	}{
+		{"valid", ScriptManifest{Access: AccessClient, Args: []ArgSpec{str("id")}, Keys: []string{"x:{id}:{player_id}"}}, true},
+		{"unknown access", ScriptManifest{Access: "public"}, false},
+		{"unknown type", ScriptManifest{Access: AccessClient, Args: []ArgSpec{{Name: "id", Type: "map"}}}, false},
+		{"reserved name", ScriptManifest{Access: AccessClient, Args: []ArgSpec{str("player_id")}}, false},
+		{"duplicate name", ScriptManifest{Access: AccessClient, Args: []ArgSpec{str("id"), str("id")}}, false},
+		{"required after optional", ScriptManifest{Access: AccessClient, Args: []ArgSpec{{Name: "a", Type: "string", Optional: true}, str("b")}}, false},
+		{"unknown variable", ScriptManifest{Access: AccessClient, Keys: []string{"x:{id}"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.manifest.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestHeaderManifest(t *testing.T) {
+	src := "-- manifest:\n-- {\"access\": \"client\",\n--  \"keys\": []}\n\n-- KEYS:\nreturn 1\n"
+	want := "{\"access\": \"client\",\n\"keys\": []}\n"
+	if got := headerManifest(src); got != want {
+		t.Errorf("headerManifest = %q, want %q", got, want)
+	}
+	if got := headerManifest("-- KEYS:\nreturn 1\n"); got != "" {
+		t.Errorf("headerManifest without manifest = %q", got)
+	}
+}
@@ -2,40 +2,65 @@ package db
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+
+	"go-server/internal/auth"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/redis/go-redis/v9"
 )
 
 type RedisManager struct {
-	Client  *redis.Client
-	PubSub  *redis.PubSub
-	scripts map[string]string // action -> sha1
-	mu      sync.RWMutex
+	Client    *redis.Client
+	PubSub    *redis.PubSub
+	scripts   map[string]*luaScript // action -> script
+	backlog   EventBacklog
+	publisher *redis.Script // see PublishEvent
+	atomic    *redis.Script // see CallScriptsAtomic
+	mu        sync.RWMutex
+	verifying atomic.Bool
+}
+
+// luaScript keeps the source next to the SHA1 so the script can be loaded
+// again after Redis loses its script cache (restart, SCRIPT FLUSH, failover).
+type luaScript struct {
+	src      string // as read from the file; Redis runs wrapScript(src)
+	sha      string
+	manifest *ScriptManifest // nil for internal-only scripts
 }
 
-func InitRedis(addr string, password string, scriptDir string) (*RedisManager, error) {
+func InitRedis(addr string, password string, scriptDir string, backlog EventBacklog) (*RedisManager, error) {
+	db := &RedisManager{
+		scripts: make(map[string]*luaScript),
+		backlog: backlog,
+	}
+	db.publisher = redis.NewScript(db.publishFunc() + "return publish_event(redis.call, ARGV[1], ARGV[2])")
+	db.atomic = redis.NewScript(db.publishFunc() + atomicPrelude + atomicRunner)
+
 	rdb := redis.NewClient(&redis.Options{
 		Addr:     addr,
 		Password: password,
+		// A new connection may point at a restarted or promoted Redis
+		// without our scripts, so check them in the background.
+		OnConnect: func(ctx context.Context, cn *redis.Conn) error {
+			go db.verifyScripts(context.Background())
+			return nil
+		},
 	})
+	db.Client = rdb
 
 	// Test connection
 	if err := rdb.Ping(context.Background()).Err(); err != nil {
 		return nil, fmt.Errorf("ping redis: %w", err)
 	}
 
-	db := &RedisManager{
-		Client:  rdb,
-		scripts: make(map[string]string),
-	}
-
 	ctx := context.Background()
 
 	// check for script directory if not creates one
@@ -83,17 +108,25 @@ func (db *RedisManager) loadScriptFile(ctx context.Context, path string) error {
 	if err != nil {
 		return err
 	}
-	sha, err := db.Client.ScriptLoad(ctx, string(data)).Result()
+	manifest, err := parseManifest(path, string(data))
+	if err != nil {
+		return err
+	}
+	sha, err := db.Client.ScriptLoad(ctx, db.wrapScript(string(data))).Result()
 	if err != nil {
 		return err
 	}
 	name := strings.TrimSuffix(filepath.Base(path), ".lua")
 
 	db.mu.Lock()
-	db.scripts[name] = sha
+	db.scripts[name] = &luaScript{src: string(data), sha: sha, manifest: manifest}
 	db.mu.Unlock()
 
-	log.Printf("Loaded script %s (%s)", name, sha)
+	access := AccessInternal
+	if manifest != nil {
+		access = manifest.Access
+	}
+	log.Printf("Loaded script %s (%s, %s)", name, sha, access)
 	return nil
 }
 
@@ -120,7 +153,13 @@ func (db *RedisManager) watchDir(ctx context.Context, dir string) error {
 		for {
 			select {
 			case event := <-watcher.Events:
-				if strings.HasSuffix(event.Name, ".lua") {
+				if strings.HasSuffix(event.Name, ".manifest.json") {
+					// Reload the script so it picks up the changed manifest
+					script := strings.TrimSuffix(event.Name, ".manifest.json") + ".lua"
+					if err := db.loadScriptFile(ctx, script); err != nil {
+						log.Printf("reload failed for %s: %v", script, err)
+					}
+				} else if strings.HasSuffix(event.Name, ".lua") {
 					if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
 						if err := db.loadScriptFile(ctx, event.Name); err != nil {
 							log.Printf("reload failed for %s: %v", event.Name, err)
@@ -141,31 +180,177 @@ func (db *RedisManager) watchDir(ctx context.Context, dir string) error {
 	return nil
 }
 
+// CallScriptAs calls a script on behalf of a client. Unlike CallScript the
+// caller does not choose KEYS: the script's manifest must allow client
+// calls and user's role, args are checked against the declared types, and
+// KEYS and ARGV are built from the manifest templates. Rejected calls
+// return a *ScriptError without reaching Redis.
+func (db *RedisManager) CallScriptAs(ctx context.Context, action string, user auth.User, args []interface{}) (map[string]interface{}, error) {
+	call, err := db.BindScript(action, user, args)
+	if err != nil {
+		return nil, err
+	}
+	return db.CallScript(ctx, call.Script, call.Keys, call.Args...)
+}
+
+// BindScript checks a client call against the script's manifest, like
+// CallScriptAs, and returns the call without running it.
+func (db *RedisManager) BindScript(action string, user auth.User, args []interface{}) (ScriptCall, error) {
+	db.mu.RLock()
+	script, ok := db.scripts[action]
+	db.mu.RUnlock()
+	if !ok {
+		return ScriptCall{}, &ScriptError{Script: action, Code: "unknown_action", Message: "unknown action " + action}
+	}
+	if script.manifest == nil {
+		return ScriptCall{}, &ScriptError{Script: action, Code: "script_not_callable", Message: action + " cannot be called by clients"}
+	}
+
+	keys, argv, err := script.manifest.bind(action, user, args)
+	if err != nil {
+		return ScriptCall{}, err
+	}
+	return ScriptCall{Script: action, Keys: keys, Args: argv}, nil
+}
+
 func (db *RedisManager) CallScript(ctx context.Context, action string, keys []string, args ...interface{}) (map[string]interface{}, error) {
 	db.mu.RLock()
-	sha, ok := db.scripts[action]
+	script, ok := db.scripts[action]
+	var sha string
+	if ok {
+		sha = script.sha
+	}
 	db.mu.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("script %s not loaded", action)
 	}
 
 	res, err := db.Client.EvalSha(ctx, sha, keys, args...).Result()
+	if isNoScript(err) {
+		// Redis lost its script cache; load the script again and retry once.
+		if sha, err = db.reloadScript(ctx, action); err == nil {
+			res, err = db.Client.EvalSha(ctx, sha, keys, args...).Result()
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	// Expect Lua scripts to return JSON-compatible maps/tables
-	switch val := res.(type) {
-	case map[string]interface{}:
-		return val, nil
-	case []interface{}:
-		// If Lua returned array, wrap into result
-		return map[string]interface{}{"result": val}, nil
-	case string:
-		return map[string]interface{}{"result": val}, nil
-	default:
+	return decodeScriptResult(action, res)
+}
+
+// ScriptError is returned by CallScript when a script reports a failure in
+// its reply, e.g. cjson.encode({status="error", code="lobby_full", err="Lobby full"}),
+// and by CallScriptAs when a call does not conform to the script's manifest.
+// Code is optional and should be one of the codes in internal/server/errcode.
+type ScriptError struct {
+	Script  string
+	Code    string
+	Message string
+	Details interface{} // the "details" of the script's reply, if any
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Script, e.Message)
+}
+
+// decodeScriptResult turns a script reply into a map. Scripts return
+// cjson.encode(...) strings, which are decoded so clients get structured
+// values instead of a JSON string. Objects are returned as-is, anything
+// else is wrapped as {"result": value}.
+func decodeScriptResult(action string, res interface{}) (map[string]interface{}, error) {
+	var val interface{} = res
+	if str, ok := res.(string); ok {
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(str), &decoded); err == nil {
+			val = decoded
+		}
+	}
+
+	obj, ok := val.(map[string]interface{})
+	if !ok {
 		return map[string]interface{}{"result": val}, nil
 	}
+
+	status, _ := obj["status"].(string)
+	errMsg, hasErr := obj["err"]
+	if status == "error" || hasErr {
+		msg, _ := errMsg.(string)
+		if msg == "" {
+			msg, _ = obj["message"].(string)
+		}
+		if msg == "" {
+			msg = "script error"
+		}
+		code, _ := obj["code"].(string)
+		return nil, &ScriptError{Script: action, Code: code, Message: msg, Details: obj["details"]}
+	}
+	return obj, nil
+}
+
+func isNoScript(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT")
+}
+
+// reloadScript loads the cached source of action into Redis again and
+// returns its SHA1.
+func (db *RedisManager) reloadScript(ctx context.Context, action string) (string, error) {
+	db.mu.RLock()
+	script, ok := db.scripts[action]
+	db.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("script %s not loaded", action)
+	}
+
+	sha, err := db.Client.ScriptLoad(ctx, db.wrapScript(script.src)).Result()
+	if err != nil {
+		return "", fmt.Errorf("reload script %s: %w", action, err)
+	}
+
+	db.mu.Lock()
+	// The file may have been reloaded or removed meanwhile.
+	if db.scripts[action] == script {
+		script.sha = sha
+	}
+	db.mu.Unlock()
+
+	log.Printf("Reloaded script %s (%s)", action, sha)
+	return sha, nil
+}
+
+// verifyScripts checks that Redis still has every loaded script and loads
+// the missing ones. Concurrent calls collapse into the one already running.
+func (db *RedisManager) verifyScripts(ctx context.Context) {
+	if !db.verifying.CompareAndSwap(false, true) {
+		return
+	}
+	defer db.verifying.Store(false)
+
+	db.mu.RLock()
+	names := make([]string, 0, len(db.scripts))
+	shas := make([]string, 0, len(db.scripts))
+	for name, script := range db.scripts {
+		names = append(names, name)
+		shas = append(shas, script.sha)
+	}
+	db.mu.RUnlock()
+	if len(shas) == 0 {
+		return
+	}
+
+	exists, err := db.Client.ScriptExists(ctx, shas...).Result()
+	if err != nil {
+		log.Printf("failed to verify scripts: %v", err)
+		return
+	}
+	for i, ok := range exists {
+		if ok {
+			continue
+		}
+		if _, err := db.reloadScript(ctx, names[i]); err != nil {
+			log.Println(err)
+		}
+	}
 }
 
 //
@@ -189,18 +374,18 @@ func (db *RedisManager) CallScript(ctx context.Context, action string, keys []st
 // 	}()
 // }
 
+// Shutdown closes the Redis client. Redis is shared by every node, so
+// scripts and data are only flushed when wipeData is set explicitly.
 func (db *RedisManager) Shutdown(ctx context.Context, wipeData bool) {
 	log.Println("Shutting down Redis...")
 
-	// Unload all Lua scripts
-	if err := db.Client.ScriptFlush(ctx).Err(); err != nil {
-		log.Printf("failed to flush scripts: %v", err)
-	} else {
-		log.Println("All Lua scripts flushed")
-	}
-
-	// Wipe data if requested
+	// Wipe scripts and data if requested
 	if wipeData {
+		if err := db.Client.ScriptFlush(ctx).Err(); err != nil {
+			log.Printf("failed to flush scripts: %v", err)
+		} else {
+			log.Println("All Lua scripts flushed")
+		}
 		if err := db.Client.FlushDB(ctx).Err(); err != nil {
 			log.Printf("failed to flush DB: %v", err)
 		} else {
@@ -0,0 +1,131 @@
+package db
+
+import "strings"
+
+// scriptLib is put in front of every script, on its first line. It holds
+// the helpers shared by the lobby scripts.
+//
+// cjson decodes JSON arrays and objects to tables alike; a table with a
+// first element is taken for an array. An empty table is encoded as only
+// one of [] and {}, so decode swaps empty containers for the EMPTY_ARRAY
+// and EMPTY_OBJECT markers and encode swaps them back. A string that is
+// exactly a marker reads as the container. Numbers become Lua doubles and
+// are written back by cjson, which rounds those with more than 14
+// significant digits, so state should keep large numbers, like IDs, in
+// strings.
+//
+// Lines are joined with spaces, so comments must be on lines of their own.
+const scriptLib = `
+local EMPTY_ARRAY, EMPTY_OBJECT = "\1[]", "\1{}"
+
+local function is_object(v)
+    return type(v) == "table" and v[1] == nil
+end
+
+-- decode decodes json with its empty containers marked. With arrays_only,
+-- empty objects stay tables, as a merge patch needs.
+local function decode(json, arrays_only)
+    local parts, from, i = {}, 1, 1
+    while true do
+        i = string.find(json, '["%[{]', i)
+        if not i then
+            break
+        end
+        local c = string.sub(json, i, i)
+        if c == '"' then
+            -- Skip the string and its escapes
+            local j = i + 1
+            while true do
+                j = string.find(json, '["\\]', j)
+                if not j or string.sub(json, j, j) == '"' then
+                    break
+                end
+                j = j + 2
+            end
+            if not j then
+                break
+            end
+            i = j + 1
+        else
+            local close = c == "[" and "]" or "}"
+            local j = string.find(json, "[^ \t\r\n]", i + 1)
+            if j and string.sub(json, j, j) == close and (c == "[" or not arrays_only) then
+                parts[#parts + 1] = string.sub(json, from, i - 1)
+                parts[#parts + 1] = c == "[" and '"\\u0001[]"' or '"\\u0001{}"'
+                from = j + 1
+            end
+            i = i + 1
+        end
+    end
+    parts[#parts + 1] = string.sub(json, from)
+    return cjson.decode(table.concat(parts))
+end
+
+-- A table still empty after a change was an object; changes only remove
+-- object fields.
+local function mark_objects(v)
+    if type(v) ~= "table" then
+        return v
+    end
+    if next(v) == nil then
+        return EMPTY_OBJECT
+    end
+    for k, child in pairs(v) do
+        v[k] = mark_objects(child)
+    end
+    return v
+end
+
+local function encode(v)
+    local json = cjson.encode(mark_objects(v))
+    return (string.gsub(json, '"\\u0001([%[{][%]}])"', "%1"))
+end
+
+-- merge_patch applies a JSON merge patch (RFC 7386) to target.
+local function merge_patch(target, patch)
+    if not is_object(patch) then
+        return patch
+    end
+    if not is_object(target) then
+        target = {}
+    end
+    for k, v in pairs(patch) do
+        if v == cjson.null then
+            target[k] = nil
+        else
+            target[k] = merge_patch(target[k], v)
+        end
+    end
+    return target
+end
+
+-- commit_tick ends tick number of a lobby, once: it drops the taken inputs
+-- the tick consumed and stores the number. It returns whether it did, or
+-- nil and an error unless the tick lock in owner holds token.
+local function commit_tick(lobby, inputs, owner, token, number, taken)
+    if redis.call("GET", owner) ~= token then
+        return nil, "not_tick_owner"
+    end
+    if (tonumber(redis.call("HGET", lobby, "tick")) or 0) >= number then
+        return false
+    end
+    redis.call("LTRIM", inputs, taken, -1)
+    redis.call("HSET", lobby, "tick", number)
+    return true
+end
+`
+
+// oneLine joins the lines of a prelude with spaces, leaving out blank and
+// comment lines, so it fits in front of the first line of a script and
+// line numbers in Redis errors still match the file.
+func oneLine(src string) string {
+	var parts []string
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+		parts = append(parts, line)
+	}
+	return strings.Join(parts, " ")
+}
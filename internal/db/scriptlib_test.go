@@ -0,0 +1,60 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestScriptLib(t *testing.T) {
+	const state = `{"a":[],"n":[{"k":{}}],"o":{}}`
+	tests := []struct {
+		name    string
+		backlog EventBacklog
+		atomic  bool
+	}{
+		{"plain", EventBacklog{}, false},
+		{"backlog", EventBacklog{Size: 10}, false},
+		{"atomic", EventBacklog{}, true},
+	}
+	for _, tt := range tests {
+		_, rm := newTestRedis(t, tt.backlog)
+		ctx := context.Background()
+		var res map[string]interface{}
+		var err error
+		if tt.atomic {
+			var results []map[string]interface{}
+			results, err = rm.CallScriptsAtomic(ctx, []ScriptCall{{Script: "roundtrip", Args: []interface{}{state}}})
+			if err == nil {
+				res = results[0]
+			}
+		} else {
+			res, err = rm.CallScript(ctx, "roundtrip", nil, state)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// Compare decoded, as cjson may order keys differently.
+		got, _ := res["json"].(string)
+		var g, w interface{}
+		json.Unmarshal([]byte(got), &g)
+		json.Unmarshal([]byte(state), &w)
+		if !reflect.DeepEqual(g, w) {
+			t.Errorf("%s: round trip = %s, want %s", tt.name, got, state)
+		}
+	}
+}
+
+func TestOneLine(t *testing.T) {
+	src := `
+-- a comment
+local s = "a  b"
+    if s then
+        s = s .. "c"
+    end
+`
+	if got, want := oneLine(src), `local s = "a  b" if s then s = s .. "c" end`; got != want {
+		t.Errorf("oneLine = %q, want %q", got, want)
+	}
+}
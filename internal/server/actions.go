@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"go-server/internal/db"
+	"go-server/internal/server/errcode"
+)
+
+// Built-in actions. Game-specific actions should live in their own files
+// and register themselves with Actions.Register from an init function.
+func init() {
+	// Subscribing again is harmless, while a replayed ack would not
+	// subscribe the new connection.
+	Actions.Use(Logging(), Idempotent("ping", "queue_stats", "resume", "subscribe", "unsubscribe"))
+
+	Actions.Register("ping", handlePing)
+	Actions.Register("subscribe", handleSubscribeAction, RequireArgs(1, "room id required"), AuthorizeChannel())
+	Actions.Register("queue_stats", handleQueueStats)
+	Actions.Register("unsubscribe", handleUnsubscribeAction, RequireArgs(1, "room id required"))
+}
+
+func handlePing(ctx context.Context, c *Connection, packet ClientMessage) {
+	c.sendResponse(packet.ID, map[string]interface{}{
+		"message": "pong",
+		"rtt_ms":  c.RTT().Milliseconds(),
+	})
+}
+
+// handleQueueStats reports the caller's own outbound queue counters.
+func handleQueueStats(ctx context.Context, c *Connection, packet ClientMessage) {
+	c.sendResponse(packet.ID, c.QueueStats())
+}
+
+func handleSubscribeAction(ctx context.Context, c *Connection, packet ClientMessage) {
+	roomID, _ := packet.Args[0].(string)
+	var since string
+	if len(packet.Args) > 1 {
+		since, _ = packet.Args[1].(string)
+	}
+	c.handleSubscribe(ctx, packet.ID, roomID, since)
+}
+
+func handleUnsubscribeAction(ctx context.Context, c *Connection, packet ClientMessage) {
+	roomID, _ := packet.Args[0].(string)
+	c.handleUnsubscribe(ctx, packet.ID, roomID)
+}
+
+// handleScriptAction is the default fallback: it calls the Lua script
+// named after the action. The script's manifest decides whether clients may
+// call it and which Redis keys it gets; clients cannot choose keys.
+func handleScriptAction(ctx context.Context, c *Connection, packet ClientMessage) {
+	if len(packet.Keys) > 0 {
+		c.sendError(packet.ID, errcode.InvalidKeys, "keys are set by the server")
+		return
+	}
+	res, err := c.rm.CallScriptAs(ctx, packet.Action, c.user, packet.Args)
+	if err != nil {
+		c.sendScriptError(packet.ID, packet.Action, err)
+		return
+	}
+	c.sendResponse(packet.ID, res)
+}
+
+// sendScriptError reports a failed CallScript. Errors raised by the script
+// itself, and catalog errors such as those of a stepBinder, are passed to
+// the client; anything else is logged and hidden behind internal_error.
+func (c *Connection) sendScriptError(id, script string, err error) {
+	var e *errcode.Error
+	if errors.As(err, &e) {
+		c.sendErrorObject(id, e)
+		return
+	}
+	var scriptErr *db.ScriptError
+	if errors.As(err, &scriptErr) {
+		c.sendErrorObject(id, scriptError(scriptErr))
+		return
+	}
+	log.Printf("%s script error: %v", script, err)
+	c.sendError(id, errcode.Internal, "failed to call "+script+" script")
+}
+
+// scriptError maps a script-level failure to a catalog error, using the
+// script's own code when it is part of the catalog.
+func scriptError(err *db.ScriptError) *errcode.Error {
+	code, ok := errcode.Lookup(err.Code)
+	if !ok {
+		code = errcode.ScriptError
+	}
+	e := errcode.New(code, err.Message)
+	if err.Details != nil {
+		e = e.WithDetails(err.Details)
+	}
+	return e
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go-server/internal/db"
+	"go-server/internal/server/errcode"
+)
+
+// batch runs the messages in its Args one after another and replies once
+// with their responses, in order. transaction does the same for script
+// actions and actions registered with registerStep, but runs them as one
+// atomic Redis call: either every script succeeds or none of their writes
+// and events take effect.
+func init() {
+	Actions.Register("batch", handleBatch, RequireArgs(1, "batch requires at least one message"))
+	Actions.Register("transaction", handleTransaction, RequireArgs(1, "transaction requires at least one message"))
+}
+
+func handleBatch(ctx context.Context, c *Connection, packet ClientMessage) {
+	entries, ok := c.batchEntries(packet)
+	if !ok {
+		return
+	}
+
+	responses := make([]ServerResponse, len(entries))
+	for i, entry := range entries {
+		resp := c.capture(entry.ID, func() {
+			if isBatchAction(entry.Action) {
+				c.sendError(entry.ID, errcode.InvalidRequest, entry.Action+" cannot be nested")
+				return
+			}
+			Actions.Dispatch(ctx, c, entry)
+		})
+		if resp == nil {
+			log.Printf("batch: %s sent no response", entry.Action)
+			resp = &ServerResponse{
+				ID:     entry.ID,
+				Type:   "response",
+				Status: "error",
+				Error:  errcode.New(errcode.Internal, entry.Action+" sent no response"),
+			}
+		}
+		responses[i] = *resp
+	}
+	c.sendResponse(packet.ID, responses)
+}
+
+func handleTransaction(ctx context.Context, c *Connection, packet ClientMessage) {
+	entries, ok := c.batchEntries(packet)
+	if !ok {
+		return
+	}
+
+	steps := make([]scriptStep, len(entries))
+	calls := make([]db.ScriptCall, len(entries))
+	for i, entry := range entries {
+		if len(entry.Keys) > 0 {
+			c.sendStepError(packet.ID, i, entry, errcode.New(errcode.InvalidKeys, "keys are set by the server"))
+			return
+		}
+		args, err := resolveRefs(entry.Args, steps[:i])
+		if err != nil {
+			c.sendStepError(packet.ID, i, entry, transactionError(err))
+			return
+		}
+		entry.Args = args
+		step, err := c.bindStep(entry)
+		if err != nil {
+			c.sendStepError(packet.ID, i, entry, transactionError(err))
+			return
+		}
+		steps[i], calls[i] = step, step.call
+	}
+
+	results, err := c.rm.CallScriptsAtomic(ctx, calls)
+	if err != nil {
+		var stepErr *db.StepError
+		if errors.As(err, &stepErr) {
+			c.sendStepError(packet.ID, stepErr.Step, entries[stepErr.Step], transactionError(stepErr.Err))
+			return
+		}
+		log.Printf("transaction failed: %v", err)
+		c.sendError(packet.ID, errcode.Internal, "transaction failed")
+		return
+	}
+
+	responses := make([]ServerResponse, len(entries))
+	for i, entry := range entries {
+		responses[i] = ServerResponse{ID: entry.ID, Type: "response", Status: "ok", Result: steps[i].result(ctx, results[i])}
+	}
+	c.sendResponse(packet.ID, responses)
+}
+
+// batchEntries decodes the messages of a batch or transaction. Entries
+// without an ID get "<batch id>.<index>" so their responses can be matched;
+// Idempotent ignores those IDs.
+// It reports false after replying with an error.
+func (c *Connection) batchEntries(packet ClientMessage) ([]ClientMessage, bool) {
+	if len(packet.Args) > c.cfg.MaxBatchSize {
+		c.sendError(packet.ID, errcode.InvalidArgs, fmt.Sprintf("at most %d messages per %s", c.cfg.MaxBatchSize, packet.Action))
+		return nil, false
+	}
+	entries := make([]ClientMessage, len(packet.Args))
+	seen := make(map[string]bool, len(packet.Args))
+	for i, arg := range packet.Args {
+		entry, err := c.codec.decodeMessage(arg)
+		if err != nil {
+			c.sendError(packet.ID, errcode.InvalidArgs, fmt.Sprintf("message %d: %v", i, err))
+			return nil, false
+		}
+		if entry.ID == "" {
+			entry.ID = fmt.Sprintf("%s.%d", packet.ID, i)
+			entry.serverID = true
+		}
+		if seen[entry.ID] {
+			c.sendError(packet.ID, errcode.InvalidArgs, "duplicate message id "+entry.ID)
+			return nil, false
+		}
+		seen[entry.ID] = true
+		entries[i] = entry
+	}
+	return entries, true
+}
+
+// scriptStep is an action bound to a single script call, so it can run on
+// its own or inside a transaction. values holds results known before the
+// script runs, which later messages of a transaction can refer to; done,
+// if set, runs once the call succeeded and returns the action's result.
+type scriptStep struct {
+	call   db.ScriptCall
+	values map[string]interface{}
+	done   func(ctx context.Context, res map[string]interface{}) interface{}
+}
+
+func (s scriptStep) result(ctx context.Context, res map[string]interface{}) interface{} {
+	if s.done == nil {
+		return res
+	}
+	return s.done(ctx, res)
+}
+
+// stepBinder binds a message to its scriptStep. It checks the message's
+// args itself and fails with an *errcode.Error or a *db.ScriptError.
+type stepBinder func(c *Connection, packet ClientMessage) (scriptStep, error)
+
+var (
+	stepMu      sync.RWMutex
+	stepBinders = make(map[string]stepBinder)
+)
+
+// registerStep registers a Go action that is a single script call, so that
+// it can also run in transactions.
+func registerStep(action string, bind stepBinder) {
+	stepMu.Lock()
+	stepBinders[action] = bind
+	stepMu.Unlock()
+	Actions.Register(action, func(ctx context.Context, c *Connection, packet ClientMessage) {
+		step, err := bind(c, packet)
+		if err != nil {
+			c.sendScriptError(packet.ID, packet.Action, err)
+			return
+		}
+		res, err := c.rm.CallScript(ctx, step.call.Script, step.call.Keys, step.call.Args...)
+		if err != nil {
+			c.sendScriptError(packet.ID, step.call.Script, err)
+			return
+		}
+		c.sendResponse(packet.ID, step.result(ctx, res))
+	})
+}
+
+// bindStep binds a message of a transaction: Go actions need to be
+// registered with registerStep, anything else is a script called through
+// its manifest.
+func (c *Connection) bindStep(entry ClientMessage) (scriptStep, error) {
+	stepMu.RLock()
+	bind := stepBinders[entry.Action]
+	stepMu.RUnlock()
+	if bind != nil {
+		return bind(c, entry)
+	}
+	if Actions.Handles(entry.Action) {
+		return scriptStep{}, errcode.New(errcode.InvalidRequest, entry.Action+" cannot run in a transaction")
+	}
+	call, err := c.rm.BindScript(entry.Action, c.user, entry.Args)
+	return scriptStep{call: call}, err
+}
+
+// resolveRefs replaces args of the form {"$ref": "<step>.<name>"} with the
+// value name of an earlier step, e.g. "0.lobby_id" for the lobby created by
+// the first message. Only values fixed before the transaction runs can be
+// referred to, not script results.
+func resolveRefs(args []interface{}, steps []scriptStep) ([]interface{}, error) {
+	var out []interface{}
+	for i, arg := range args {
+		obj, _ := arg.(map[string]interface{})
+		ref, ok := obj["$ref"].(string)
+		if !ok || len(obj) != 1 {
+			continue
+		}
+		v, ok := refValue(ref, steps)
+		if !ok {
+			return nil, errcode.New(errcode.InvalidArgs, fmt.Sprintf("arg %d: %s names no value of an earlier message", i+1, ref))
+		}
+		if out == nil {
+			out = slices.Clone(args)
+		}
+		out[i] = v
+	}
+	if out == nil {
+		return args, nil
+	}
+	return out, nil
+}
+
+func refValue(ref string, steps []scriptStep) (interface{}, bool) {
+	stepStr, name, _ := strings.Cut(ref, ".")
+	n, err := strconv.Atoi(stepStr)
+	if err != nil || n < 0 || n >= len(steps) {
+		return nil, false
+	}
+	v, ok := steps[n].values[name]
+	return v, ok
+}
+
+// sendStepError fails a whole transaction, naming the message that failed
+// next to any details of its error.
+func (c *Connection) sendStepError(id string, step int, entry ClientMessage, e *errcode.Error) {
+	details := map[string]interface{}{}
+	if d, ok := e.Details.(map[string]interface{}); ok {
+		maps.Copy(details, d)
+	}
+	details["step"] = step
+	details["id"] = entry.ID
+	c.sendErrorObject(id, e.WithDetails(details))
+}
+
+// transactionError maps the failure of one transaction step to a catalog
+// error, like sendScriptError.
+func transactionError(err error) *errcode.Error {
+	var e *errcode.Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var scriptErr *db.ScriptError
+	if errors.As(err, &scriptErr) {
+		return scriptError(scriptErr)
+	}
+	log.Printf("transaction step error: %v", err)
+	return errcode.New(errcode.Internal, "transaction step failed")
+}
+
+func isBatchAction(action string) bool {
+	return action == "batch" || action == "transaction"
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"go-server/internal/auth"
+	"go-server/internal/db"
+)
+
+func TestBatchSubscribe(t *testing.T) {
+	_, rm := newTestRedis(t, db.EventBacklog{})
+	s := NewServer(context.Background(), rm, nil, Config{ChannelPolicy: &ChannelPolicy{Default: AllowAny}})
+	t.Cleanup(func() { s.Close() })
+	alice := serveTest(t, s)(auth.User{ID: 1, Username: "alice", Role: auth.RoleUser})
+
+	alice.send(`{"Id":"b","Action":"batch","Args":[` +
+		`{"Id":"s","Action":"subscribe","Args":["news"]},` +
+		`{"Action":"ping"},` +
+		`{"Id":"u","Action":"unsubscribe","Args":["news"]}]}`)
+	resp := alice.response("b")
+	results, _ := resp["result"].([]interface{})
+	tests := []struct {
+		id, key string
+	}{
+		{"s", "subscribed"},
+		{"b.1", "message"},
+		{"u", "unsubscribed"},
+	}
+	if len(results) != len(tests) {
+		t.Fatalf("got %v, want %d responses", resp, len(tests))
+	}
+	for i, tt := range tests {
+		r, _ := results[i].(map[string]interface{})
+		result, _ := r["result"].(map[string]interface{})
+		if r["Id"] != tt.id || r["Status"] != "ok" || result[tt.key] == nil {
+			t.Errorf("response %d = %v, want %s with %s", i, r, tt.id, tt.key)
+		}
+	}
+
+	// No acks were sent besides the batch reply.
+	alice.send(`{"Id":"p","Action":"ping"}`)
+	alice.response("p")
+}
+
+func TestTransactionLobby(t *testing.T) {
+	mr, rm := newTestRedis(t, db.EventBacklog{})
+	s := NewServer(context.Background(), rm, nil, Config{})
+	t.Cleanup(func() { s.Close() })
+	alice := serveTest(t, s)(auth.User{ID: 1, Username: "alice", Role: auth.RoleUser})
+
+	// The subscribe ack of a join comes first, without an id.
+	reply := func(id string) map[string]interface{} {
+		t.Helper()
+		for {
+			msg := alice.read()
+			if msg["Type"] == "response" && msg["Id"] != "" {
+				if msg["Id"] != id {
+					t.Fatalf("got response %v, want one to %q", msg, id)
+				}
+				return msg
+			}
+		}
+	}
+
+	alice.send(`{"Id":"t1","Action":"transaction","Args":[` +
+		`{"Action":"create_lobby","Args":[4]},` +
+		`{"Action":"set_max_players","Args":[{"$ref":"0.lobby_id"},8]},` +
+		`{"Action":"join_lobby","Args":[{"$ref":"0.lobby_id"},"{}"]}]}`)
+	resp := reply("t1")
+	results, _ := resp["result"].([]interface{})
+	if resp["Status"] != "ok" || len(results) != 3 {
+		t.Fatalf("got %v, want 3 responses", resp)
+	}
+	created, _ := results[0].(map[string]interface{})["result"].(map[string]interface{})
+	lobby_id, _ := created["lobby_id"].(string)
+	if got := mr.HGet(LobbyKey(lobby_id), "max_players"); got != "8" {
+		t.Errorf("max_players = %q, want 8", got)
+	}
+	if !mr.Exists(LobbyPlayersKey(lobby_id)) {
+		t.Error("alice did not join the lobby")
+	}
+
+	tests := []struct {
+		id   string
+		msg  string
+		code string
+		step float64
+	}{
+		{"f1", `[{"Action":"create_lobby"},` +
+			`{"Action":"join_lobby","Args":[{"$ref":"0.lobby_id"},"{}"]},` +
+			`{"Action":"join_lobby","Args":[{"$ref":"0.lobby_id"},"{}"]}]`, "already_in_lobby", 2},
+		{"f2", `[{"Action":"create_lobby"},` +
+			`{"Action":"join_lobby","Args":[{"$ref":"1.lobby_id"},"{}"]}]`, "invalid_args", 1},
+		{"f3", `[{"Action":"create_lobby"},{"Action":"ping"}]`, "invalid_request", 1},
+		{"f4", `[{"Action":"leave_lobby"}]`, "missing_args", 0},
+	}
+	for _, tt := range tests {
+		alice.send(`{"Id":"` + tt.id + `","Action":"transaction","Args":` + tt.msg + `}`)
+		resp := reply(tt.id)
+		e, _ := resp["error"].(map[string]interface{})
+		details, _ := e["details"].(map[string]interface{})
+		if e["code"] != tt.code || details["step"] != tt.step {
+			t.Errorf("%s: got %v, want %s at step %v", tt.id, resp, tt.code, tt.step)
+		}
+	}
+	// Nothing of the failed transactions was kept.
+	if keys := slices.DeleteFunc(mr.Keys(), func(key string) bool {
+		return strings.HasPrefix(key, "idempotency:")
+	}); len(keys) != 3 {
+		t.Errorf("keys = %v, want only those of the first lobby", keys)
+	}
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go-server/internal/server/errcode"
+
+	"github.com/coder/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Subprotocols name an encoding and a wire schema version, e.g. json.v2.
+// Clients that request none get json.v1, the schema shipped clients use.
+const (
+	SubprotocolJSON      = "json.v1"
+	SubprotocolMsgpack   = "msgpack.v1"
+	SubprotocolJSONV2    = "json.v2"
+	SubprotocolMsgpackV2 = "msgpack.v2"
+)
+
+var (
+	JSONCodec      = &Codec{enc: jsonEncoding, version: 1}
+	MsgpackCodec   = &Codec{enc: msgpackEncoding, version: 1}
+	JSONCodecV2    = &Codec{enc: jsonEncoding, version: 2}
+	MsgpackCodecV2 = &Codec{enc: msgpackEncoding, version: 2}
+)
+
+// codecs lists the supported codecs in order of server preference: a client
+// offering several subprotocols gets the first one listed here.
+var codecs = []*Codec{JSONCodecV2, MsgpackCodecV2, JSONCodec, MsgpackCodec}
+
+// Subprotocols returns the subprotocols offered to clients.
+func Subprotocols() []string {
+	names := make([]string, len(codecs))
+	for i, codec := range codecs {
+		names[i] = codec.Subprotocol()
+	}
+	return names
+}
+
+// codecFor returns the codec of a negotiated subprotocol. An empty
+// subprotocol selects json.v1.
+func codecFor(subprotocol string) (*Codec, error) {
+	if subprotocol == "" {
+		return JSONCodec, nil
+	}
+	for _, codec := range codecs {
+		if codec.Subprotocol() == subprotocol {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported subprotocol %q", subprotocol)
+}
+
+// requestedSubprotocols returns the subprotocols listed in the handshake.
+func requestedSubprotocols(r *http.Request) []string {
+	var protocols []string
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(value, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	return protocols
+}
+
+// negotiable reports whether any of the requested subprotocols is
+// supported. Requesting none is fine: the client gets json.v1.
+func negotiable(requested []string) bool {
+	if len(requested) == 0 {
+		return true
+	}
+	for _, p := range requested {
+		if _, err := codecFor(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// encoding is a serialization format shared by all schema versions.
+type encoding struct {
+	name        string
+	messageType websocket.MessageType
+	marshal     func(v interface{}) ([]byte, error)
+	unmarshal   func(data []byte, v interface{}) error
+	// normalize converts decoded args to the types encoding/json produces,
+	// so handlers and script manifests see the same values in every mode.
+	normalize func(v interface{}) interface{}
+}
+
+var jsonEncoding = &encoding{
+	name:        "json",
+	messageType: websocket.MessageText,
+	marshal:     json.Marshal,
+	unmarshal:   json.Unmarshal,
+}
+
+// MessagePack uses the json struct tags, so field names are the same as in
+// JSON for a given schema version.
+var msgpackEncoding = &encoding{
+	name:        "msgpack",
+	messageType: websocket.MessageBinary,
+	marshal: func(v interface{}) ([]byte, error) {
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json")
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+	unmarshal: func(data []byte, v interface{}) error {
+		dec := msgpack.NewDecoder(bytes.NewReader(data))
+		dec.SetCustomStructTag("json")
+		return dec.Decode(v)
+	},
+	normalize: jsonValue,
+}
+
+// Codec encodes the frames exchanged with a client. It pairs an encoding
+// with a wire schema version. ClientMessage and ServerResponse carry the
+// frozen v1 tags; later versions are translated to and from their own wire
+// structs here.
+type Codec struct {
+	enc     *encoding
+	version int
+}
+
+// Subprotocol is the WebSocket subprotocol the codec is negotiated as.
+func (c *Codec) Subprotocol() string { return fmt.Sprintf("%s.v%d", c.enc.name, c.version) }
+
+// Version is the wire schema version.
+func (c *Codec) Version() int { return c.version }
+
+// MessageType is the frame type the codec writes.
+func (c *Codec) MessageType() websocket.MessageType { return c.enc.messageType }
+
+func (c *Codec) Marshal(v interface{}) ([]byte, error) {
+	if c.version >= 2 {
+		if resp, ok := v.(ServerResponse); ok {
+			v = newServerResponseV2(resp)
+		}
+	}
+	return c.enc.marshal(v)
+}
+
+func (c *Codec) Unmarshal(data []byte, v interface{}) error {
+	packet, isPacket := v.(*ClientMessage)
+	if isPacket && c.version >= 2 {
+		var wire clientMessageV2
+		if err := c.enc.unmarshal(data, &wire); err != nil {
+			return err
+		}
+		*packet = wire.message()
+	} else if err := c.enc.unmarshal(data, v); err != nil {
+		return err
+	}
+	if isPacket && c.enc.normalize != nil {
+		for i, arg := range packet.Args {
+			packet.Args[i] = c.enc.normalize(arg)
+		}
+	}
+	return nil
+}
+
+// clientMessageV2 is the v2 wire form of ClientMessage.
+type clientMessageV2 struct {
+	ID     string        `json:"id"`
+	Type   string        `json:"type,omitempty"`
+	Action string        `json:"action"`
+	Keys   []string      `json:"keys,omitempty"`
+	Args   []interface{} `json:"args,omitempty"`
+}
+
+func (m clientMessageV2) message() ClientMessage {
+	return ClientMessage{ID: m.ID, Type: m.Type, Action: m.Action, Keys: m.Keys, Args: m.Args}
+}
+
+// serverResponseV2 is the v2 wire form of ServerResponse.
+type serverResponseV2 struct {
+	ID     string         `json:"id"`
+	Type   string         `json:"type"`
+	Status string         `json:"status"`
+	Result interface{}    `json:"result,omitempty"`
+	Error  *errcode.Error `json:"error,omitempty"`
+}
+
+func newServerResponseV2(r ServerResponse) serverResponseV2 {
+	result := r.Result
+	if responses, ok := result.([]ServerResponse); ok {
+		// Batch replies nest the responses of their messages.
+		nested := make([]serverResponseV2, len(responses))
+		for i, resp := range responses {
+			nested[i] = newServerResponseV2(resp)
+		}
+		result = nested
+	}
+	return serverResponseV2{ID: r.ID, Type: r.Type, Status: r.Status, Result: result, Error: r.Error}
+}
+
+// decodeMessage converts a ClientMessage nested in the Args of another
+// message, such as a batch entry, using the codec's schema version.
+func (c *Codec) decodeMessage(v interface{}) (ClientMessage, error) {
+	var packet ClientMessage
+	if _, ok := v.(map[string]interface{}); !ok {
+		return packet, fmt.Errorf("expected a message object")
+	}
+	// Args are already normalized to JSON types, so go through JSON.
+	data, err := json.Marshal(v)
+	if err != nil {
+		return packet, err
+	}
+	versioned := &Codec{enc: jsonEncoding, version: c.version}
+	err = versioned.Unmarshal(data, &packet)
+	return packet, err
+}
+
+// jsonValue converts a value decoded from MessagePack to the type
+// encoding/json would have decoded it as: numbers become float64, binary
+// becomes string and maps get string keys.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int8:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint8:
+		return float64(v)
+	case uint16:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case []byte:
+		return string(v)
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+		return v
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonValue(e)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	}
+	return v
+}
+
+// event is a broadcast payload shared by many connections. Payloads are
+// published as JSON and are the same in every schema version; each
+// encoding re-encodes it at most once.
+type event struct {
+	data []byte
+
+	mu     sync.Mutex
+	frames map[*encoding][]byte
+}
+
+func newEvent(data []byte) *event {
+	return &event{data: data}
+}
+
+// frame returns the event encoded for codec.
+func (e *event) frame(codec *Codec) ([]byte, error) {
+	if codec.enc == jsonEncoding {
+		return e.data, nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if frame, ok := e.frames[codec.enc]; ok {
+		return frame, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(e.data, &v); err != nil {
+		// Not JSON: pass the payload through as a string.
+		v = string(e.data)
+	}
+	frame, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if e.frames == nil {
+		e.frames = make(map[*encoding][]byte)
+	}
+	e.frames[codec.enc] = frame
+	return frame, nil
+}
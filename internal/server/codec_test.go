@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"go-server/internal/server/errcode"
+)
+
+func TestCodecUnmarshal(t *testing.T) {
+	want := ClientMessage{ID: "1", Action: "join_lobby", Args: []interface{}{"abc", 3.0, map[string]interface{}{"x": 1.0}}}
+	wire := map[string]interface{}{"Id": "1", "Action": "join_lobby", "Args": []interface{}{"abc", 3, map[string]interface{}{"x": 1}}}
+	wireV2 := map[string]interface{}{"id": "1", "action": "join_lobby", "args": []interface{}{"abc", 3, map[string]interface{}{"x": 1}}}
+
+	tests := []struct {
+		codec *Codec
+		wire  map[string]interface{}
+	}{
+		{JSONCodec, wire},
+		{MsgpackCodec, wire},
+		{JSONCodecV2, wireV2},
+		{MsgpackCodecV2, wireV2},
+	}
+	for _, tt := range tests {
+		data, err := tt.codec.enc.marshal(tt.wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got ClientMessage
+		if err := tt.codec.Unmarshal(data, &got); err != nil {
+			t.Errorf("%s: %v", tt.codec.Subprotocol(), err)
+			continue
+		}
+		// MessagePack args are normalized to what encoding/json decodes.
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, want %#v", tt.codec.Subprotocol(), got, want)
+		}
+	}
+}
+
+func TestCodecMarshalResponse(t *testing.T) {
+	resp := ServerResponse{
+		ID:     "b1",
+		Type:   "response",
+		Status: "ok",
+		Result: []ServerResponse{
+			{ID: "1", Type: "response", Status: "ok", Result: "pong"},
+			{ID: "2", Type: "response", Status: "error", Error: errcode.New(errcode.MissingArgs, "lobby id required")},
+		},
+	}
+	tests := []struct {
+		codec *Codec
+		want  string
+	}{
+		{JSONCodec, `{"Id":"b1","Type":"response","Status":"ok","result":[` +
+			`{"Id":"1","Type":"response","Status":"ok","result":"pong"},` +
+			`{"Id":"2","Type":"response","Status":"error","error":{"code":"missing_args","message":"lobby id required","retryable":false}}]}`},
+		{JSONCodecV2, `{"id":"b1","type":"response","status":"ok","result":[` +
+			`{"id":"1","type":"response","status":"ok","result":"pong"},` +
+			`{"id":"2","type":"response","status":"error","error":{"code":"missing_args","message":"lobby id required","retryable":false}}]}`},
+	}
+	for _, tt := range tests {
+		data, err := tt.codec.Marshal(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertJSONEqual(t, tt.codec.Subprotocol(), data, tt.want)
+
+		// MessagePack uses the same field names as JSON.
+		msgpackCodec := &Codec{enc: msgpackEncoding, version: tt.codec.version}
+		data, err = msgpackCodec.Marshal(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v interface{}
+		if err := msgpackCodec.enc.unmarshal(data, &v); err != nil {
+			t.Fatal(err)
+		}
+		data, _ = json.Marshal(jsonValue(v))
+		assertJSONEqual(t, msgpackCodec.Subprotocol(), data, tt.want)
+	}
+}
+
+func TestCodecDecodeMessage(t *testing.T) {
+	tests := []struct {
+		codec *Codec
+		entry interface{}
+		want  ClientMessage
+		ok    bool
+	}{
+		{JSONCodec, map[string]interface{}{"Id": "1", "Action": "ping"}, ClientMessage{ID: "1", Action: "ping"}, true},
+		{JSONCodecV2, map[string]interface{}{"id": "1", "action": "ping", "args": []interface{}{"x"}}, ClientMessage{ID: "1", Action: "ping", Args: []interface{}{"x"}}, true},
+		{MsgpackCodecV2, map[string]interface{}{"id": "1", "action": "ping"}, ClientMessage{ID: "1", Action: "ping"}, true},
+		{JSONCodec, "ping", ClientMessage{}, false},
+		{JSONCodec, []interface{}{"ping"}, ClientMessage{}, false},
+	}
+	for _, tt := range tests {
+		got, err := tt.codec.decodeMessage(tt.entry)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: decodeMessage(%v) error = %v, want ok %v", tt.codec.Subprotocol(), tt.entry, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: decodeMessage(%v) = %+v, want %+v", tt.codec.Subprotocol(), tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	tests := []struct {
+		requested []string
+		ok        bool
+	}{
+		{nil, true},
+		{[]string{"json.v2"}, true},
+		{[]string{"xml.v1", "msgpack.v1"}, true},
+		{[]string{"json.v3"}, false},
+		{[]string{"json"}, false},
+	}
+	for _, tt := range tests {
+		if got := negotiable(tt.requested); got != tt.ok {
+			t.Errorf("negotiable(%q) = %v, want %v", tt.requested, got, tt.ok)
+		}
+	}
+	if codec, err := codecFor(""); err != nil || codec != JSONCodec {
+		t.Errorf(`codecFor("") = %v, %v; want json.v1`, codec, err)
+	}
+	for _, codec := range codecs {
+		if got, err := codecFor(codec.Subprotocol()); err != nil || got != codec {
+			t.Errorf("codecFor(%q) = %v, %v", codec.Subprotocol(), got, err)
+		}
+	}
+}
+
+func assertJSONEqual(t *testing.T, name string, got []byte, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("%s: bad expectation: %v", name, err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("%s:\n got %s\nwant %s", name, got, want)
+	}
+}
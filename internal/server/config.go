@@ -0,0 +1,87 @@
+package server
+
+import "time"
+
+// Config holds the tunables of a Server. Zero values fall back to defaults.
+type Config struct {
+	// ChannelPolicy decides which channels clients may subscribe to.
+	// Defaults to DefaultChannelPolicy.
+	ChannelPolicy *ChannelPolicy
+
+	// PingInterval is how often clients are pinged; negative disables
+	// pings. PingTimeout bounds each ping. Pings close dead and half-open
+	// sockets; IdleTimeout, if positive, also closes connections whose
+	// client sent no message for that long, even if it answers pings. It
+	// is off by default, since listen-only clients send no messages.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+	IdleTimeout  time.Duration
+
+	// SendQueueLimit caps the queued broadcast events per connection, and
+	// SendQueuePolicy decides what happens beyond it. Responses to the
+	// client's own requests are never dropped; a client with SendQueueLimit
+	// unsent responses is disconnected.
+	SendQueueLimit  int
+	SendQueuePolicy OverflowPolicy
+
+	// MaxBatchSize caps the messages in one batch or transaction.
+	MaxBatchSize int
+
+	// IdempotencyTTL is how long the response to a message ID is kept to
+	// answer resent copies; negative disables deduplication.
+	IdempotencyTTL time.Duration
+
+	// ResumeTTL is how long a dropped connection's session can be resumed
+	// and its lobby memberships are kept; negative disables sessions.
+	ResumeTTL time.Duration
+
+	// TickHandler, if set, advances every lobby with players on this node
+	// TickRate times per second; see TickScheduler.
+	TickHandler TickHandler
+	TickRate    int
+}
+
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPingTimeout  = 10 * time.Second
+
+	defaultSendQueueLimit  = 256
+	defaultSendQueuePolicy = DropOldest
+
+	defaultMaxBatchSize = 32
+
+	defaultIdempotencyTTL = 5 * time.Minute
+	defaultResumeTTL      = 2 * time.Minute
+	defaultTickRate       = 20
+)
+
+func (cfg Config) withDefaults() Config {
+	if cfg.ChannelPolicy == nil {
+		cfg.ChannelPolicy = DefaultChannelPolicy()
+	}
+	if cfg.PingInterval == 0 {
+		cfg.PingInterval = defaultPingInterval
+	}
+	if cfg.PingTimeout <= 0 {
+		cfg.PingTimeout = defaultPingTimeout
+	}
+	if cfg.SendQueueLimit <= 0 {
+		cfg.SendQueueLimit = defaultSendQueueLimit
+	}
+	if cfg.SendQueuePolicy == "" {
+		cfg.SendQueuePolicy = defaultSendQueuePolicy
+	}
+	if cfg.MaxBatchSize <= 0 {
+		cfg.MaxBatchSize = defaultMaxBatchSize
+	}
+	if cfg.IdempotencyTTL == 0 {
+		cfg.IdempotencyTTL = defaultIdempotencyTTL
+	}
+	if cfg.ResumeTTL == 0 {
+		cfg.ResumeTTL = defaultResumeTTL
+	}
+	if cfg.TickRate <= 0 {
+		cfg.TickRate = defaultTickRate
+	}
+	return cfg
+}
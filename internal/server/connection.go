@@ -3,205 +3,348 @@ package server
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"go-server/internal/auth"
 	"go-server/internal/db"
+	"go-server/internal/server/errcode"
 
 	"github.com/coder/websocket"
 	gonanoid "github.com/matoous/go-nanoid/v2"
-	"github.com/redis/go-redis/v9"
 )
 
 // Message represents a WebSocket message with type, sender ID, channel, and content.
+// The json tags are the frozen v1 wire schema; newer schema versions are
+// mapped onto this struct by their Codec.
 type ClientMessage struct {
 	ID     string        `json:"Id"`
 	Type   string        `json:"Yype"`
 	Action string        `json:"Action"`
 	Keys   []string      `json:"Keys"` // Add this
 	Args   []interface{} `json:"Args"`
+
+	serverID bool // ID was made up by batchEntries, not sent by the client
 }
 
+// ServerResponse is a reply to a ClientMessage. Like ClientMessage, its tags
+// are the frozen v1 wire schema.
 type ServerResponse struct {
-	ID     string      `json:"Id"`
-	Type   string      `json:"Type"` // "response"
-	Status string      `json:"Status"`
-	Result interface{} `json:"result,omitempty"`
-	Error  string      `json:"error,omitempty"`
+	ID     string         `json:"Id"`
+	Type   string         `json:"Type"` // "response"
+	Status string         `json:"Status"`
+	Result interface{}    `json:"result,omitempty"`
+	Error  *errcode.Error `json:"error,omitempty"`
 }
 
 type Connection struct {
-	rm        *db.RedisManager
-	conn      *websocket.Conn
-	SendCh    chan []byte
-	user      auth.User
-	subClient *redis.Client
-	pubsub    *redis.PubSub
-	// UserID  int  // <-- Add this
-	// IsGuest bool // <-- Add this
-}
-
-func NewConnection(rm *db.RedisManager, conn *websocket.Conn, user auth.User) *Connection {
-	subClient := redis.NewClient(&redis.Options{
-		Addr:     rm.Client.Options().Addr,
-		Password: rm.Client.Options().Password,
-		DB:       0, // use default DB
-	})
+	ID       string
+	rm       *db.RedisManager
+	router   *SubscriptionRouter
+	hub      *Hub
+	sessions *SessionStore  // nil if sessions are disabled
+	ticks    *TickScheduler // nil if lobbies don't tick
+	cfg      Config
+	conn     *websocket.Conn
+	codec    *Codec
+	queue    *SendQueue
+	user     auth.User
+	hb       heartbeatState
+
+	mu           sync.Mutex
+	lobbies      map[string]struct{} // lobbies joined through this connection
+	cancel       context.CancelFunc
+	onDisconnect []func(*Connection)
+	collecting   map[string]*responseSlot // responses held back by capture
+	session      string                   // resume token
+	holding      bool                     // live events are held in held
+	held         []heldEvent
+	wg           sync.WaitGroup
+	closeOnce    sync.Once
+}
+
+// cleanupTimeout bounds the Redis calls made when a connection closes.
+const cleanupTimeout = 5 * time.Second
+
+// NewConnection wraps an accepted socket. The codec is chosen from the
+// subprotocol negotiated by websocket.Accept.
+func NewConnection(srv *Server, conn *websocket.Conn, user auth.User) (*Connection, error) {
+	codec, err := codecFor(conn.Subprotocol())
+	if err != nil {
+		return nil, err
+	}
+	id, err := gonanoid.New()
+	if err != nil {
+		return nil, err
+	}
 	c := &Connection{
-		rm:        rm,
-		conn:      conn,
-		SendCh:    make(chan []byte, 16),
-		user:      user,
-		subClient: subClient,
-		// UserID:  userID, // <-- Set it
-		// IsGuest: isGuest,
-	}
-	return c
-}
-
-func (c *Connection) handleSubscribe(ctx context.Context, roomID string) {
-	if c.pubsub == nil {
-		c.pubsub = c.subClient.Subscribe(ctx, roomID)
-		go c.listenPubSub(ctx)
-	} else {
-		err := c.pubsub.Subscribe(ctx, roomID)
-		if err != nil {
-			c.sendError("", "subscribe", err.Error())
-			return
+		ID:       id,
+		rm:       srv.rm,
+		router:   srv.router,
+		hub:      srv.hub,
+		sessions: srv.sessions,
+		ticks:    srv.ticks,
+		cfg:      srv.cfg,
+		conn:     conn,
+		codec:    codec,
+		user:     user,
+		lobbies:  make(map[string]struct{}),
+	}
+	c.queue = NewSendQueue(srv.cfg.SendQueueLimit, srv.cfg.SendQueuePolicy, func() {
+		log.Printf("disconnecting slow consumer %s (%s)", c.ID, c.user.Username)
+		go c.conn.Close(websocket.StatusPolicyViolation, "slow consumer")
+	})
+	c.touch()
+	return c, nil
+}
+
+// QueueStats returns the depth and drop counters of the outbound queue.
+func (c *Connection) QueueStats() QueueStats {
+	return c.queue.Stats()
+}
+
+// pushEvent queues broadcast traffic received on channel, encoded with the
+// connection's codec. It reports whether the event was queued.
+func (c *Connection) pushEvent(channel string, ev *event) bool {
+	c.mu.Lock()
+	if c.holding {
+		c.held = append(c.held, heldEvent{channel: channel, ev: ev})
+		c.mu.Unlock()
+		return true
+	}
+	c.mu.Unlock()
+	return c.queueEvent(channel, ev)
+}
+
+// heldEvent is a live event that arrived while a resume was replaying.
+type heldEvent struct {
+	channel string
+	ev      *event
+}
+
+// holdEvents makes pushEvent keep live events back until releaseEvents.
+func (c *Connection) holdEvents() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.holding = true
+}
+
+// releaseEvents queues the held events and lets live events through again.
+// Held events at or before replayed[channel] were already replayed and are
+// dropped.
+func (c *Connection) releaseEvents(replayed map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, h := range c.held {
+		if last, ok := replayed[h.channel]; ok {
+			var evt struct {
+				Seq string `json:"seq"`
+			}
+			if json.Unmarshal(h.ev.data, &evt) == nil && evt.Seq != "" && compareSeq(evt.Seq, last) <= 0 {
+				continue
+			}
 		}
+		c.queueEvent(h.channel, h.ev)
+	}
+	c.held = nil
+	c.holding = false
+}
+
+// catchUp queues the events of channel after since from its backlog and
+// returns the seq of the last one, or since if there were none, and their
+// number. Live events should be held meanwhile.
+func (c *Connection) catchUp(ctx context.Context, channel, since string) (string, int) {
+	events, err := c.rm.EventsSince(ctx, channel, since, int64(c.cfg.SendQueueLimit))
+	if err != nil {
+		log.Printf("replay %s failed: %v", channel, err)
+		return since, 0
+	}
+	for _, e := range events {
+		c.queueEvent(channel, newEvent(eventData(e)))
+		since = e.Seq
 	}
-	c.sendResponse("", map[string]string{"subscribed": roomID})
+	return since, len(events)
 }
 
-func (c *Connection) handleUnsubscribe(ctx context.Context, roomID string) {
-	if c.pubsub != nil {
-		err := c.pubsub.Unsubscribe(ctx, roomID)
+// queueEvent encodes ev and puts it in the send queue.
+func (c *Connection) queueEvent(channel string, ev *event) bool {
+	frame, err := ev.frame(c.codec)
+	if err != nil {
+		log.Printf("encode event for %s failed: %v", c.ID, err)
+		return false
+	}
+	msg := outMsg{data: frame}
+	if c.queue.policy == Coalesce {
+		msg.key = eventKey(channel, ev.data)
+	}
+	return c.queue.Push(msg)
+}
+
+// pushResponse queues a reply to the client's own request.
+func (c *Connection) pushResponse(data []byte) {
+	if !c.queue.Push(outMsg{data: data, critical: true}) {
+		log.Printf("response to %s (%s) not queued: connection closing", c.ID, c.user.Username)
+	}
+}
+
+// sendEvent queues a server event, such as the session event, ahead of
+// broadcast traffic.
+func (c *Connection) sendEvent(v interface{}) {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		log.Printf("%s encode error: %v", c.codec.Subprotocol(), err)
+		return
+	}
+	c.pushResponse(data)
+}
+
+// User returns the authenticated user of the connection.
+func (c *Connection) User() auth.User {
+	return c.user
+}
+
+func (c *Connection) handleSubscribe(ctx context.Context, id, roomID, since string) {
+	ack, err := c.subscribe(ctx, roomID, since)
+	if err != nil {
+		c.sendError(id, errcode.SubscribeFailed, err.Error())
+		return
+	}
+	c.sendResponse(id, ack)
+}
+
+// subscribe subscribes the connection to roomID and returns the
+// acknowledgement. If since is set, the events after it are replayed from
+// the channel's backlog first. Otherwise a lobby channel comes with a
+// snapshot of the lobby, and only the events after it follow.
+func (c *Connection) subscribe(ctx context.Context, roomID, since string) (map[string]interface{}, error) {
+	lobbyID, isLobby := lobbyOfChannel(roomID)
+	var replayed map[string]string
+	if since != "" || isLobby {
+		// Hold live events until the missed ones are queued or the
+		// snapshot is taken.
+		c.holdEvents()
+		replayed = make(map[string]string)
+		defer func() { c.releaseEvents(replayed) }()
+	}
+	if err := c.router.Subscribe(ctx, c, roomID); err != nil {
+		return nil, err
+	}
+	c.hub.subscribed(c, roomID)
+
+	ack := map[string]interface{}{"subscribed": roomID}
+	switch {
+	case since != "":
+		replayed[roomID], ack["replayed"] = c.catchUp(ctx, roomID, since)
+	case isLobby:
+		snapshot, err := c.lobbySnapshot(ctx, lobbyID)
 		if err != nil {
-			c.sendError("", "unsubscribe", err.Error())
-			return
+			log.Printf("snapshot of lobby %s failed: %v", lobbyID, err)
+			break
+		}
+		ack["snapshot"] = snapshot
+		if seq, ok := snapshot["seq"].(string); ok {
+			replayed[roomID] = seq
 		}
-		c.sendResponse("", map[string]string{"unsubscribed": roomID})
 	}
+	return ack, nil
 }
 
-func (c *Connection) listenPubSub(ctx context.Context) {
-	ch := c.pubsub.Channel()
-	for {
-		select {
-		case msg := <-ch:
-			if msg == nil {
-				return
-			}
-			c.SendCh <- []byte(msg.Payload)
-		case <-ctx.Done():
-			return
-		}
+func (c *Connection) handleUnsubscribe(ctx context.Context, id, roomID string) {
+	if err := c.router.Unsubscribe(ctx, c, roomID); err != nil {
+		c.sendError(id, errcode.UnsubscribeFailed, err.Error())
+		return
 	}
+	c.hub.unsubscribed(c, roomID)
+	c.sendResponse(id, map[string]string{"unsubscribed": roomID})
 }
 
-func (c *Connection) ReadPump(ctx context.Context) {
-	defer func() {
-		c.conn.Close(websocket.StatusNormalClosure, "closing")
+// Serve runs the connection's read, write and heartbeat loops until the
+// socket closes or ctx is done, then closes the connection.
+func (c *Connection) Serve(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	c.mu.Lock()
+	c.cancel = cancel
+	c.mu.Unlock()
+	defer c.Close()
+
+	c.wg.Add(2)
+	go func() {
+		defer c.wg.Done()
+		c.WritePump(ctx)
+	}()
+	go func() {
+		defer c.wg.Done()
+		c.heartbeat(ctx)
 	}()
 
+	c.ReadPump(ctx)
+}
+
+// OnDisconnect registers fn to run when the connection closes. Hooks run
+// in order of registration.
+func (c *Connection) OnDisconnect(fn func(*Connection)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onDisconnect = append(c.onDisconnect, fn)
+}
+
+// Close tears the connection down: it cancels the connection context,
+// closes the socket, waits for the write and heartbeat loops, discards
+// unsent messages, suspends the session or else leaves joined lobbies,
+// unsubscribes from every channel and runs the OnDisconnect hooks. It is
+// safe to call more than once, but not from the write or heartbeat loop or
+// from a hook.
+func (c *Connection) Close() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		cancel := c.cancel
+		hooks := c.onDisconnect
+		c.mu.Unlock()
+
+		if cancel != nil {
+			cancel()
+		}
+		c.conn.Close(websocket.StatusNormalClosure, "closing")
+		c.wg.Wait()
+
+		c.queue.Close()
+		if n := c.queue.drain(); n > 0 {
+			log.Printf("discarded %d unsent messages for %s (%s)", n, c.ID, c.user.Username)
+		}
+
+		// The connection context is already done here, so use a fresh one.
+		ctx, cancelCleanup := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancelCleanup()
+		if !c.suspend(ctx) {
+			c.leaveAllLobbies(ctx)
+		}
+		c.router.UnsubscribeAll(ctx, c)
+
+		for _, hook := range hooks {
+			hook(c)
+		}
+	})
+}
+
+func (c *Connection) ReadPump(ctx context.Context) {
 	for {
 		_, msg, err := c.conn.Read(ctx)
 		if err != nil {
 			log.Println("read error:", err)
 			break
 		}
+		c.touch()
 
 		// Parse incoming message
 		var packet ClientMessage
-		if err := json.Unmarshal(msg, &packet); err != nil {
-			log.Println("json unmarshal error:", err)
+		if err := c.codec.Unmarshal(msg, &packet); err != nil {
+			log.Printf("%s decode error: %v", c.codec.Subprotocol(), err)
 			continue
 		}
 
 		// Dispatch based on action
-		switch packet.Action {
-		case "ping":
-			c.sendResponse(packet.ID, map[string]string{"message": "pong"})
-		case "subscribe":
-			if len(packet.Args) < 1 {
-				c.sendError(packet.ID, "missing_args", "room id required")
-				break
-			}
-			roomID, _ := packet.Args[0].(string)
-			c.handleSubscribe(ctx, roomID)
-		case "unsubscribe":
-			if len(packet.Args) < 1 {
-				c.sendError(packet.ID, "missing_args", "room id required")
-				break
-			}
-			roomID, _ := packet.Args[0].(string)
-			c.handleUnsubscribe(ctx, roomID)
-		case "create_lobby":
-			// Special case for lobby id creation: just return some info
-			lobby_id, err := gonanoid.New(5)
-			if err != nil {
-				c.sendError(packet.ID, "internal_error", "failed to generate lobby")
-				break
-			}
-			// Call script to create lobby in Redis
-			// KEYS:
-			// KEYS[1] = "lobby:<lobbyId>"
-			_, err = c.rm.CallScript(ctx, "create_lobby", []string{"lobby:" + lobby_id}, packet.Args...)
-			if err != nil {
-				log.Println("create_lobby script error:", err)
-				c.sendError(packet.ID, "internal_error", "failed to call create_lobby script")
-				break
-			}
-			c.sendResponse(packet.ID, map[string]string{"lobby_id": lobby_id})
-		case "join_lobby":
-			if len(packet.Args) < 2 {
-				c.sendError(packet.ID, "missing_args", "lobby id required")
-				break
-			}
-			lobby_id, _ := packet.Args[0].(string)
-			player_id := c.user.Username
-
-			keys := []string{
-				"lobby:" + lobby_id,
-				"lobby:" + lobby_id + ":players",
-			}
-
-			allArgs := []interface{}{lobby_id, player_id}
-			allArgs = append(allArgs, packet.Args[1:]...)
-
-			res, err := c.rm.CallScript(ctx, "join_lobby", keys, allArgs...)
-			if err != nil {
-				log.Println("join_lobby script error:", err)
-				c.sendError(packet.ID, "internal_error", "failed to call join_lobby script")
-				break
-			}
-
-			c.handleSubscribe(ctx, "lobby:"+lobby_id+":events")
-
-			c.sendResponse(packet.ID, res)
-		default:
-			// Allow multi-key Lua script calls
-			if len(packet.Keys) < 1 {
-				c.sendError(packet.ID, "invalid_keys", "missing Redis keys")
-				continue
-			}
-			// Optional: Validate keys are non-empty strings
-			for _, k := range packet.Keys {
-				if k == "" {
-					c.sendError(packet.ID, "invalid_keys", "all keys must be non-empty strings")
-					continue
-				}
-			}
-			// Call Lua script dynamically with any number of keys
-			res, err := c.rm.CallScript(ctx, packet.Action, packet.Keys, packet.Args...)
-			if err != nil {
-				c.sendError(packet.ID, "script_error", err.Error())
-			} else {
-				c.sendResponse(packet.ID, res)
-			}
-
-		}
+		Actions.Dispatch(ctx, c, packet)
 	}
 }
 
@@ -209,44 +352,95 @@ func (c *Connection) WritePump(ctx context.Context) {
 	defer c.conn.Close(websocket.StatusNormalClosure, "writer closing")
 
 	for {
-		select {
-		case msg := <-c.SendCh:
-			// If you need a specific deadline per write:
-			// c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-			err := c.conn.Write(ctx, websocket.MessageText, msg)
-			if err != nil {
-				log.Println("write error:", err)
-				return // Use return instead of break
-			}
-		case <-ctx.Done(): // Check for context cancellation
+		msg, ok := c.queue.Pop(ctx)
+		if !ok {
+			return
+		}
+		err := c.conn.Write(ctx, c.codec.MessageType(), msg)
+		if err != nil {
+			log.Println("write error:", err)
 			return
 		}
 	}
 }
 
 func (c *Connection) sendResponse(id string, result interface{}) {
-	resp := ServerResponse{
+	c.reply(ServerResponse{
 		ID:     id,
 		Type:   "response",
 		Status: "ok",
 		Result: result,
+	})
+}
+
+func (c *Connection) sendError(id string, code errcode.Code, msg string) {
+	c.sendErrorObject(id, errcode.New(code, msg))
+}
+
+func (c *Connection) sendErrorObject(id string, e *errcode.Error) {
+	c.reply(ServerResponse{
+		ID:     id,
+		Type:   "response",
+		Status: "error",
+		Error:  e,
+	})
+}
+
+// reply encodes resp and queues it, unless a capture collects it.
+func (c *Connection) reply(resp ServerResponse) {
+	if c.collect(resp) {
+		return
 	}
-	data, err := json.Marshal(resp)
-	log.Println("Sending response:", string(data))
+	data, err := c.codec.Marshal(resp)
 	if err != nil {
-		log.Println("json marshal error:", err)
+		log.Printf("%s encode error: %v", c.codec.Subprotocol(), err)
 		return
 	}
-	c.SendCh <- data
+	c.pushResponse(data)
 }
 
-func (c *Connection) sendError(id, code, msg string) {
-	resp := ServerResponse{
-		ID:     id,
-		Type:   "response",
-		Status: "error",
-		Error:  fmt.Sprintf("%s: %s", code, msg),
+// responseSlot holds the response captured for one message ID.
+type responseSlot struct {
+	resp *ServerResponse
+}
+
+// capture runs fn and returns the first response it sent for id instead
+// of sending it, or nil if it sent none. Captures for the same id nest:
+// the innermost one gets the response.
+func (c *Connection) capture(id string, fn func()) *ServerResponse {
+	slot := &responseSlot{}
+	c.mu.Lock()
+	if c.collecting == nil {
+		c.collecting = make(map[string]*responseSlot)
+	}
+	outer, nested := c.collecting[id]
+	c.collecting[id] = slot
+	c.mu.Unlock()
+
+	// Restore the outer capture even if fn panics, so the error reply
+	// reaches whoever handles the panic.
+	defer func() {
+		c.mu.Lock()
+		if nested {
+			c.collecting[id] = outer
+		} else {
+			delete(c.collecting, id)
+		}
+		c.mu.Unlock()
+	}()
+	fn()
+	return slot.resp
+}
+
+// collect stores resp if a capture is waiting for it. It reports whether
+// resp was collected.
+func (c *Connection) collect(resp ServerResponse) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	slot, ok := c.collecting[resp.ID]
+	if !ok || slot.resp != nil {
+		return false
 	}
-	data, _ := json.Marshal(resp)
-	c.SendCh <- data
+	slot.resp = &resp
+	return true
 }
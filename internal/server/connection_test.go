@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"go-server/internal/auth"
+	"go-server/internal/db"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coder/websocket"
+)
+
+// newTestRedis returns a RedisManager with the repo's scripts loaded into
+// an in-memory Redis. miniredis has no cjson.null and cannot DUMP hashes.
+func newTestRedis(t *testing.T, backlog db.EventBacklog) (*miniredis.Miniredis, *db.RedisManager) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rm, err := db.InitRedis(mr.Addr(), "", "../../lua_scripts", backlog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rm.Client.Close() })
+	return mr, rm
+}
+
+// testClient is a JSON v1 WebSocket client of a test server.
+type testClient struct {
+	t  *testing.T
+	ws *websocket.Conn
+}
+
+// serveTest serves s over HTTP and returns a function that connects as
+// user.
+func serveTest(t *testing.T, s *Server) func(user auth.User) *testClient {
+	t.Helper()
+	users := make(chan auth.User, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		s.serveConn(r.Context(), ws, <-users)
+	}))
+	t.Cleanup(ts.Close)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	return func(user auth.User) *testClient {
+		t.Helper()
+		users <- user
+		ws, _, err := websocket.Dial(context.Background(), url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ws.CloseNow() })
+		return &testClient{t: t, ws: ws}
+	}
+}
+
+func (tc *testClient) send(msg string) {
+	tc.t.Helper()
+	if err := tc.ws.Write(context.Background(), websocket.MessageText, []byte(msg)); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// read returns the next message, failing the test after two seconds.
+func (tc *testClient) read() map[string]interface{} {
+	tc.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, data, err := tc.ws.Read(ctx)
+	if err != nil {
+		tc.t.Fatalf("read: %v", err)
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		tc.t.Fatalf("read %s: %v", data, err)
+	}
+	return msg
+}
+
+// response reads up to the response to id, skipping events.
+func (tc *testClient) response(id string) map[string]interface{} {
+	tc.t.Helper()
+	for {
+		msg := tc.read()
+		if msg["Type"] == "response" {
+			if msg["Id"] != id {
+				tc.t.Fatalf("got response %v, want one to %q", msg, id)
+			}
+			return msg
+		}
+	}
+}
+
+// event reads up to the next event of type typ, skipping other events.
+func (tc *testClient) event(typ string) map[string]interface{} {
+	tc.t.Helper()
+	for {
+		msg := tc.read()
+		if msg["Type"] == "response" {
+			tc.t.Fatalf("got response %v, want a %s event", msg, typ)
+		}
+		if msg["type"] == typ {
+			return msg
+		}
+	}
+}
+
+// newTestServer returns a Server whose connections never reach Redis as
+// long as they don't subscribe or join lobbies.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s := &Server{
+		rm: &db.RedisManager{},
+		router: &SubscriptionRouter{
+			subs:  make(map[string]map[*Connection]struct{}),
+			conns: make(map[*Connection]map[string]struct{}),
+		},
+		hub: NewHub(),
+		cfg: Config{PingInterval: 50 * time.Millisecond}.withDefaults(),
+	}
+	go s.hub.Run(ctx)
+	return s
+}
+
+func TestConnectionCloseReleasesGoroutines(t *testing.T) {
+	s := newTestServer(t)
+	disconnected := make(chan string, 1)
+	s.OnDisconnect(func(c *Connection) { disconnected <- c.ID })
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		s.serveConn(r.Context(), ws, auth.User{ID: 1, Username: "test", Role: auth.RoleUser})
+	}))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	cycle := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ws, _, err := websocket.Dial(ctx, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ws.Write(ctx, websocket.MessageText, []byte(`{"Id":"1","Action":"ping"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if _, msg, err := ws.Read(ctx); err != nil || !strings.Contains(string(msg), "pong") {
+			t.Fatalf("ping: %s, %v", msg, err)
+		}
+		ws.Close(websocket.StatusNormalClosure, "bye")
+
+		select {
+		case <-disconnected:
+		case <-ctx.Done():
+			t.Fatal("disconnect hook did not run")
+		}
+	}
+
+	// Warm up so lazily started runtime and http goroutines are counted.
+	cycle()
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 100; i++ {
+		cycle()
+	}
+
+	if len(s.hub.Connections()) != 0 {
+		t.Fatalf("hub still tracks %d connections", len(s.hub.Connections()))
+	}
+
+	// Idle keep-alive goroutines of the test HTTP server may take a moment
+	// to go away, so allow a little slack and some time.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= baseline+2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("goroutines leaked: baseline %d, now %d\n%s", baseline, n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,119 @@
+// Package errcode is the catalog of error codes returned to clients, both in
+// the error object of a WebSocket ServerResponse and in the JSON body of the
+// HTTP auth endpoints. Codes are part of the wire protocol: add new ones, but
+// never rename or reuse an existing code.
+package errcode
+
+import "fmt"
+
+type Code string
+
+const (
+	// Request errors: the client sent something the server cannot act on.
+	InvalidRequest   Code = "invalid_request"    // malformed JSON or body
+	MethodNotAllowed Code = "method_not_allowed" // wrong HTTP method
+	MissingArgs      Code = "missing_args"       // a required argument is missing
+	InvalidArgs      Code = "invalid_args"       // an argument has the wrong type or value
+	InvalidKeys      Code = "invalid_keys"       // Redis keys missing or empty
+	UnknownAction    Code = "unknown_action"     // no handler or script for the action
+
+	// Deduplication errors, see server.Idempotent.
+	RequestInProgress Code = "request_in_progress" // a resent message whose first copy is still running
+
+	// Session errors.
+	SessionExpired Code = "session_expired" // resume token unknown, expired or already used
+
+	// Handshake errors, returned before the WebSocket upgrade.
+	UnsupportedProtocol Code = "unsupported_protocol" // no requested subprotocol or protocol version is supported
+
+	// Auth errors.
+	Unauthorized       Code = "unauthorized"        // missing or invalid token, or insufficient role
+	Forbidden          Code = "forbidden"           // authenticated, but not allowed by policy
+	InvalidCredentials Code = "invalid_credentials" // wrong username or password
+	UsernameTaken      Code = "username_taken"      // registration with an existing username
+
+	// Lobby errors, reported by the bundled lobby scripts.
+	LobbyExists     Code = "lobby_exists"     // create_lobby with an id already in use
+	LobbyNotFound   Code = "lobby_not_found"  // lobby does not exist
+	LobbyFull       Code = "lobby_full"       // lobby reached max_players
+	AlreadyInLobby  Code = "already_in_lobby" // player already joined the lobby
+	NotInLobby      Code = "not_in_lobby"     // player is not a member of the lobby
+	LobbyLocked     Code = "lobby_locked"     // host locked the lobby against new joins
+	NotLobbyHost    Code = "not_lobby_host"   // host-only action by another player
+	VersionConflict Code = "version_conflict" // update_state based on an outdated state version
+
+	// Server errors.
+	ScriptError       Code = "script_error"        // a Lua script failed without a more specific code
+	ScriptNotCallable Code = "script_not_callable" // script is internal-only or has no manifest
+	SubscribeFailed   Code = "subscribe_failed"    // Redis SUBSCRIBE failed
+	UnsubscribeFailed Code = "unsubscribe_failed"  // Redis UNSUBSCRIBE failed
+	Internal          Code = "internal_error"      // unexpected server-side failure
+	Unavailable       Code = "server_unavailable"  // server is shutting down, reconnect later
+)
+
+// catalog holds every known code and whether repeating a request that failed
+// with it may succeed.
+var catalog = map[Code]bool{
+	InvalidRequest:      false,
+	MethodNotAllowed:    false,
+	MissingArgs:         false,
+	InvalidArgs:         false,
+	InvalidKeys:         false,
+	UnknownAction:       false,
+	RequestInProgress:   true,
+	SessionExpired:      false,
+	UnsupportedProtocol: false,
+	Unauthorized:        false,
+	Forbidden:           false,
+	InvalidCredentials:  false,
+	UsernameTaken:       false,
+	LobbyExists:         false,
+	LobbyNotFound:       false,
+	LobbyFull:           false,
+	AlreadyInLobby:      false,
+	NotInLobby:          false,
+	LobbyLocked:         false,
+	NotLobbyHost:        false,
+	VersionConflict:     false,
+	ScriptError:         false,
+	ScriptNotCallable:   false,
+	SubscribeFailed:     true,
+	UnsubscribeFailed:   true,
+	Internal:            true,
+	Unavailable:         true,
+}
+
+// Retryable reports whether repeating a request that failed with c may succeed.
+func (c Code) Retryable() bool {
+	return catalog[c]
+}
+
+// Lookup returns the Code for s if it is part of the catalog.
+func Lookup(s string) (Code, bool) {
+	c := Code(s)
+	_, ok := catalog[c]
+	return c, ok
+}
+
+// Error is the error object sent to clients.
+type Error struct {
+	Code      Code        `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	Retryable bool        `json:"retryable"`
+}
+
+func New(code Code, msg string) *Error {
+	return &Error{Code: code, Message: msg, Retryable: code.Retryable()}
+}
+
+// WithDetails returns a copy of e carrying details.
+func (e *Error) WithDetails(details interface{}) *Error {
+	cp := *e
+	cp.Details = details
+	return &cp
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
@@ -0,0 +1,13 @@
+package errcode
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// WriteHTTP writes e as {"error": {...}} with the given HTTP status.
+func WriteHTTP(w http.ResponseWriter, status int, e *Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]*Error{"error": e})
+}
@@ -1,27 +1,97 @@
 package server
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
 
 	"go-server/internal/auth"
 	"go-server/internal/db"
+	"go-server/internal/server/errcode"
 
 	"github.com/coder/websocket"
 )
 
-func ServeWS(rm *db.RedisManager, w http.ResponseWriter, r *http.Request, authProvider auth.AuthProvider) {
+// Server holds the node-wide state shared by all WebSocket connections.
+type Server struct {
+	rm           *db.RedisManager
+	authProvider auth.AuthProvider
+	router       *SubscriptionRouter
+	hub          *Hub
+	sessions     *SessionStore  // nil if Config.ResumeTTL is negative
+	ticks        *TickScheduler // nil without Config.TickHandler
+	cfg          Config
+
+	mu              sync.Mutex
+	shutdown        bool
+	disconnectHooks []func(*Connection)
+	active          sync.WaitGroup // tracked connections not yet closed
+}
+
+func NewServer(ctx context.Context, rm *db.RedisManager, authProvider auth.AuthProvider, cfg Config) *Server {
+	s := &Server{
+		cfg:          cfg.withDefaults(),
+		rm:           rm,
+		authProvider: authProvider,
+		hub:          NewHub(),
+	}
+	if rm.Streams() {
+		s.router = NewStreamRouter(ctx, rm)
+	} else {
+		s.router = NewSubscriptionRouter(ctx, rm.Client)
+	}
+	if s.cfg.ResumeTTL > 0 {
+		s.sessions = NewSessionStore(ctx, rm, s.cfg.ResumeTTL)
+	}
+	if s.cfg.TickHandler != nil {
+		s.ticks = NewTickScheduler(rm, s.cfg.TickHandler, s.cfg.TickRate)
+	}
+	go s.hub.Run(ctx)
+	return s
+}
+
+// Hub returns the registry of live connections on this node.
+func (s *Server) Hub() *Hub {
+	return s.hub
+}
+
+// Close stops ticking lobbies and sweeping sessions, and releases the
+// node-wide Redis subscription or stream reader.
+func (s *Server) Close() error {
+	if s.ticks != nil {
+		s.ticks.Close()
+	}
+	if s.sessions != nil {
+		s.sessions.Close()
+	}
+	return s.router.Close()
+}
+
+func (s *Server) ServeWS(w http.ResponseWriter, r *http.Request) {
+	if s.isShuttingDown() {
+		errcode.WriteHTTP(w, http.StatusServiceUnavailable, errcode.New(errcode.Unavailable, "Server is shutting down"))
+		return
+	}
+
+	if requested := requestedSubprotocols(r); !negotiable(requested) {
+		errcode.WriteHTTP(w, http.StatusBadRequest, errcode.New(errcode.UnsupportedProtocol,
+			"Unsupported protocol "+strings.Join(requested, ", ")).WithDetails(map[string][]string{"supported": Subprotocols()}))
+		return
+	}
+
 	// Simple token auth (in real app, use JWT or session)
 	tokenStr := r.URL.Query().Get("token")
 	if tokenStr == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
+		errcode.WriteHTTP(w, http.StatusUnauthorized, errcode.New(errcode.Unauthorized, "Missing token"))
 		return
 	}
 
 	// Validate JWT (now returns userID + isGuest flag)
-	user, err := auth.ValidateJWT(tokenStr, authProvider, rm.Client)
+	user, err := auth.ValidateJWT(tokenStr, s.authProvider, s.rm.Client)
 	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		errcode.WriteHTTP(w, http.StatusUnauthorized, errcode.New(errcode.Unauthorized, "Invalid token"))
 		return
 	}
 
@@ -29,15 +99,47 @@ func ServeWS(rm *db.RedisManager, w http.ResponseWriter, r *http.Request, authPr
 
 	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		OriginPatterns: []string{"*"},
+		Subprotocols:   Subprotocols(),
 	})
 	if err != nil {
 		log.Println("WebSocket accept error:", err)
 		return
 	}
 
-	conn := NewConnection(rm, c, user)
+	s.serveConn(r.Context(), c, user)
+}
+
+// serveConn runs an accepted socket until it closes.
+func (s *Server) serveConn(ctx context.Context, ws *websocket.Conn, user auth.User) {
+	conn, err := NewConnection(s, ws, user)
+	if err != nil {
+		log.Println("WebSocket connection error:", err)
+		ws.Close(websocket.StatusInternalError, "internal error")
+		return
+	}
+	if !s.track(conn) {
+		ws.Close(websocket.StatusServiceRestart, "server shutting down")
+		return
+	}
+	defer s.active.Done()
+	conn.OnDisconnect(s.untrack)
+	if s.sessions != nil {
+		conn.startSession()
+	}
+	s.mu.Lock()
+	hooks := s.disconnectHooks
+	s.mu.Unlock()
+	for _, hook := range hooks {
+		conn.OnDisconnect(hook)
+	}
+
+	conn.Serve(ctx) // Blocking until client disconnects
+}
 
-	// Start writer goroutine
-	go conn.WritePump(r.Context())
-	conn.ReadPump(r.Context()) // Blocking until client disconnects
+// OnDisconnect registers fn to run whenever a connection on this server
+// closes, after its lobbies and subscriptions have been released.
+func (s *Server) OnDisconnect(fn func(*Connection)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnectHooks = append(s.disconnectHooks, fn)
 }
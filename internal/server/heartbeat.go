@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// heartbeatState is the liveness data of a Connection.
+type heartbeatState struct {
+	lastSeen atomic.Int64 // unix nanos of the last client message
+	rtt      atomic.Int64 // nanos of the last successful ping
+}
+
+// touch records that the client sent a message.
+func (c *Connection) touch() {
+	c.hb.lastSeen.Store(time.Now().UnixNano())
+}
+
+// RTT returns the round-trip time of the last successful ping, or 0 if no
+// ping has completed yet.
+func (c *Connection) RTT() time.Duration {
+	return time.Duration(c.hb.rtt.Load())
+}
+
+// LastSeen returns when the client last sent a message.
+func (c *Connection) LastSeen() time.Time {
+	return time.Unix(0, c.hb.lastSeen.Load())
+}
+
+// heartbeat closes the connection when a ping, sent every PingInterval,
+// times out, or when the client sent no message for IdleTimeout. Closing
+// the socket makes ReadPump return, which runs the normal cleanup path. It
+// returns when ctx is done.
+func (c *Connection) heartbeat(ctx context.Context) {
+	var wg sync.WaitGroup
+	if c.cfg.PingInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.pingLoop(ctx)
+		}()
+	}
+	if c.cfg.IdleTimeout > 0 {
+		c.idleLoop(ctx)
+	}
+	wg.Wait()
+}
+
+// idleLoop closes the connection once the client sent no message for
+// IdleTimeout. Answering pings does not count: a client that is alive but
+// idle is closed too.
+func (c *Connection) idleLoop(ctx context.Context) {
+	timer := time.NewTimer(c.cfg.IdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+		idle := time.Since(c.LastSeen())
+		if idle >= c.cfg.IdleTimeout {
+			log.Printf("closing idle connection %s (%s)", c.ID, c.user.Username)
+			c.conn.Close(websocket.StatusGoingAway, "idle timeout")
+			return
+		}
+		timer.Reset(c.cfg.IdleTimeout - idle)
+	}
+}
+
+// pingLoop pings the client every PingInterval and records the RTT.
+func (c *Connection) pingLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, c.cfg.PingTimeout)
+		start := time.Now()
+		err := c.conn.Ping(pingCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("ping to %s (%s) failed: %v", c.ID, c.user.Username, err)
+			c.conn.Close(websocket.StatusGoingAway, "ping timeout")
+			return
+		}
+		c.hb.rtt.Store(int64(time.Since(start)))
+	}
+}
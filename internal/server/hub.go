@@ -1,43 +1,216 @@
 package server
 
+import (
+	"context"
+
+	"github.com/coder/websocket"
+)
+
+// Hub tracks the live connections on this node, indexed by connection ID,
+// user ID and subscribed channel. All state is owned by the Run loop; the
+// exported methods hand work to it over channels.
 type Hub struct {
 	clients    map[*Connection]bool
+	byID       map[string]*Connection
+	byUser     map[int]map[*Connection]struct{}
+	byChannel  map[string]map[*Connection]struct{}
 	register   chan *Connection
 	unregister chan *Connection
 	broadcast  chan []byte
+	ops        chan func()
+	done       chan struct{}
 }
 
 func NewHub() *Hub {
 	return &Hub{
 		clients:    make(map[*Connection]bool),
+		byID:       make(map[string]*Connection),
+		byUser:     make(map[int]map[*Connection]struct{}),
+		byChannel:  make(map[string]map[*Connection]struct{}),
 		register:   make(chan *Connection),
 		unregister: make(chan *Connection),
 		broadcast:  make(chan []byte),
+		ops:        make(chan func()),
+		done:       make(chan struct{}),
 	}
 }
 
-func (h *Hub) Run() {
+func (h *Hub) Run(ctx context.Context) {
+	defer close(h.done)
 	for {
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
+			h.add(client)
 
 		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.sendCh)
-			}
+			h.remove(client)
 
 		case msg := <-h.broadcast:
+			ev := newEvent(msg)
 			for client := range h.clients {
-				select {
-				case client.sendCh <- msg:
-				default:
-					// drop slow client
-					delete(h.clients, client)
-					close(client.sendCh)
-				}
+				h.deliver(client, ev)
+			}
+
+		case op := <-h.ops:
+			op()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Register adds c to the hub.
+func (h *Hub) Register(c *Connection) {
+	select {
+	case h.register <- c:
+	case <-h.done:
+	}
+}
+
+// Unregister removes c and its channel index entries from the hub.
+func (h *Hub) Unregister(c *Connection) {
+	select {
+	case h.unregister <- c:
+	case <-h.done:
+	}
+}
+
+// Broadcast queues msg, a JSON payload, for every connection on this node.
+func (h *Hub) Broadcast(msg []byte) {
+	select {
+	case h.broadcast <- msg:
+	case <-h.done:
+	}
+}
+
+// Connection returns the connection with the given ID.
+func (h *Hub) Connection(id string) (*Connection, bool) {
+	var c *Connection
+	h.do(func() { c = h.byID[id] })
+	return c, c != nil
+}
+
+// Connections returns every live connection.
+func (h *Hub) Connections() []*Connection {
+	var conns []*Connection
+	h.do(func() {
+		for c := range h.clients {
+			conns = append(conns, c)
+		}
+	})
+	return conns
+}
+
+// UserConnections returns the connections of the given user.
+func (h *Hub) UserConnections(userID int) []*Connection {
+	var conns []*Connection
+	h.do(func() { conns = keys(h.byUser[userID]) })
+	return conns
+}
+
+// ChannelConnections returns the connections subscribed to channel.
+func (h *Hub) ChannelConnections(channel string) []*Connection {
+	var conns []*Connection
+	h.do(func() { conns = keys(h.byChannel[channel]) })
+	return conns
+}
+
+// SendToUser queues msg for every connection of the given user and returns
+// how many connections it was queued for.
+func (h *Hub) SendToUser(userID int, msg []byte) int {
+	n := 0
+	h.do(func() {
+		ev := newEvent(msg)
+		for c := range h.byUser[userID] {
+			if h.deliver(c, ev) {
+				n++
 			}
 		}
+	})
+	return n
+}
+
+// Disconnect closes every connection of the given user and returns how many
+// were closed. The normal ReadPump exit path unregisters them.
+func (h *Hub) Disconnect(userID int, code websocket.StatusCode, reason string) int {
+	conns := h.UserConnections(userID)
+	for _, c := range conns {
+		go c.conn.Close(code, reason)
+	}
+	return len(conns)
+}
+
+// subscribed records that c joined channel.
+func (h *Hub) subscribed(c *Connection, channel string) {
+	h.do(func() {
+		if !h.clients[c] {
+			return
+		}
+		if h.byChannel[channel] == nil {
+			h.byChannel[channel] = make(map[*Connection]struct{})
+		}
+		h.byChannel[channel][c] = struct{}{}
+	})
+}
+
+// unsubscribed records that c left channel.
+func (h *Hub) unsubscribed(c *Connection, channel string) {
+	h.do(func() { removeFrom(h.byChannel, channel, c) })
+}
+
+// do runs op on the Run loop and waits for it to finish.
+func (h *Hub) do(op func()) {
+	finished := make(chan struct{})
+	select {
+	case h.ops <- func() { op(); close(finished) }:
+		<-finished
+	case <-h.done:
+	}
+}
+
+func (h *Hub) add(c *Connection) {
+	h.clients[c] = true
+	h.byID[c.ID] = c
+	if h.byUser[c.user.ID] == nil {
+		h.byUser[c.user.ID] = make(map[*Connection]struct{})
+	}
+	h.byUser[c.user.ID][c] = struct{}{}
+}
+
+func (h *Hub) remove(c *Connection) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	delete(h.byID, c.ID)
+	removeFrom(h.byUser, c.user.ID, c)
+	for channel := range h.byChannel {
+		removeFrom(h.byChannel, channel, c)
+	}
+}
+
+// deliver queues ev for c. Slow clients are handled by the connection's
+// SendQueue overflow policy, which may disconnect them.
+func (h *Hub) deliver(c *Connection, ev *event) bool {
+	return c.pushEvent("", ev)
+}
+
+func keys(set map[*Connection]struct{}) []*Connection {
+	conns := make([]*Connection, 0, len(set))
+	for c := range set {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func removeFrom[K comparable](index map[K]map[*Connection]struct{}, key K, c *Connection) {
+	set, ok := index[key]
+	if !ok {
+		return
+	}
+	delete(set, c)
+	if len(set) == 0 {
+		delete(index, key)
 	}
 }
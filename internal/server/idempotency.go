@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"go-server/internal/server/errcode"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// idempotencyRecord is stored per (user, message ID). Response is nil
+// while the action is still running. The responses nested in a batch
+// reply are kept apart in Nested, since a Result decoded from JSON would
+// no longer be a []ServerResponse that codecs can translate.
+type idempotencyRecord struct {
+	Action   string           `json:"action"`
+	Response *ServerResponse  `json:"response,omitempty"`
+	Nested   []ServerResponse `json:"nested,omitempty"`
+}
+
+func newIdempotencyRecord(action string, resp *ServerResponse) idempotencyRecord {
+	rec := idempotencyRecord{Action: action, Response: resp}
+	if nested, ok := resp.Result.([]ServerResponse); ok {
+		stored := *resp
+		stored.Result = nil
+		rec.Response, rec.Nested = &stored, nested
+	}
+	return rec
+}
+
+// response returns the stored response as it was first sent.
+func (rec idempotencyRecord) response() ServerResponse {
+	resp := *rec.Response
+	if rec.Nested != nil {
+		resp.Result = rec.Nested
+	}
+	return resp
+}
+
+// ReplayHook runs before a stored successful response is replayed. It
+// restores connection-local state the action set up, e.g. the lobby
+// subscription made by join_lobby, and reports false if the response no
+// longer holds, in which case the action runs again.
+type ReplayHook func(ctx context.Context, c *Connection, packet ClientMessage) bool
+
+var (
+	replayMu    sync.RWMutex
+	replayHooks = make(map[string]ReplayHook)
+)
+
+// OnReplay registers the ReplayHook of action.
+func OnReplay(action string, hook ReplayHook) {
+	replayMu.Lock()
+	defer replayMu.Unlock()
+	replayHooks[action] = hook
+}
+
+func idempotencyKey(userID int, messageID string) string {
+	return fmt.Sprintf("idempotency:%d:%s", userID, messageID)
+}
+
+// Idempotent makes resent messages safe: the response to each message ID
+// is kept in Redis for Config.IdempotencyTTL per user, and a message that
+// reuses an ID gets that response replayed instead of running the action
+// again, on any connection or node. Messages without an ID, the actions
+// in skip, batch entries without a client ID and responses with a
+// retryable error are not remembered.
+// Clients must therefore use unique message IDs, e.g. random ones.
+func Idempotent(skip ...string) Middleware {
+	skipped := make(map[string]bool, len(skip))
+	for _, action := range skip {
+		skipped[action] = true
+	}
+	return func(next ActionHandler) ActionHandler {
+		return func(ctx context.Context, c *Connection, packet ClientMessage) {
+			ttl := c.cfg.IdempotencyTTL
+			if packet.ID == "" || packet.serverID || ttl < 0 || skipped[packet.Action] {
+				next(ctx, c, packet)
+				return
+			}
+
+			key := idempotencyKey(c.user.ID, packet.ID)
+			pending, _ := json.Marshal(idempotencyRecord{Action: packet.Action})
+			first, err := c.rm.Client.SetNX(ctx, key, pending, ttl).Result()
+			if err != nil {
+				// Without Redis nothing can be remembered; run the action.
+				log.Printf("idempotency check for %s failed: %v", packet.ID, err)
+				next(ctx, c, packet)
+				return
+			}
+			if !first && c.replay(ctx, key, packet) {
+				return
+			}
+
+			done := false
+			defer func() {
+				if !done {
+					// The action panicked; release the ID so a retry can run.
+					delCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+					defer cancel()
+					c.rm.Client.Del(delCtx, key)
+				}
+			}()
+			resp := c.capture(packet.ID, func() { next(ctx, c, packet) })
+			done = true
+
+			// Store even if the connection is closing, so the retry that
+			// follows finds the response.
+			storeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+			defer cancel()
+			if resp == nil || (resp.Error != nil && resp.Error.Retryable) {
+				err = c.rm.Client.Del(storeCtx, key).Err()
+			} else {
+				data, _ := json.Marshal(newIdempotencyRecord(packet.Action, resp))
+				err = c.rm.Client.Set(storeCtx, key, data, ttl).Err()
+			}
+			if err != nil {
+				log.Printf("idempotency store for %s failed: %v", packet.ID, err)
+			}
+
+			if resp != nil {
+				c.reply(*resp)
+			}
+		}
+	}
+}
+
+// replay answers a message whose ID was already used. It reports false if
+// the action should run again instead.
+func (c *Connection) replay(ctx context.Context, key string, packet ClientMessage) bool {
+	data, err := c.rm.Client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		// Expired or released just now; the client may simply retry.
+		c.sendError(packet.ID, errcode.RequestInProgress, "request is still running")
+		return true
+	}
+	if err != nil {
+		log.Printf("idempotency lookup for %s failed: %v", packet.ID, err)
+		c.sendError(packet.ID, errcode.Internal, "failed to look up request")
+		return true
+	}
+
+	var rec idempotencyRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		log.Printf("idempotency record %s is corrupt: %v", key, err)
+		c.sendError(packet.ID, errcode.Internal, "failed to look up request")
+		return true
+	}
+	if rec.Action != packet.Action {
+		c.sendError(packet.ID, errcode.InvalidRequest, fmt.Sprintf("message id %s was already used for %s", packet.ID, rec.Action))
+		return true
+	}
+	if rec.Response == nil {
+		c.sendError(packet.ID, errcode.RequestInProgress, "request is still running")
+		return true
+	}
+
+	if rec.Response.Status == "ok" {
+		replayMu.RLock()
+		hook := replayHooks[packet.Action]
+		replayMu.RUnlock()
+		if hook != nil && !hook(ctx, c, packet) {
+			return false
+		}
+	}
+	c.reply(rec.response())
+	return true
+}
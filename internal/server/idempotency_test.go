@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"go-server/internal/auth"
+	"go-server/internal/db"
+	"go-server/internal/server/errcode"
+)
+
+func TestRestoreJoinLobbyWithoutArgs(t *testing.T) {
+	// Replaying a join_lobby that was rejected for missing args must not
+	// panic; the hook runs before RequireArgs.
+	c := &Connection{rm: &db.RedisManager{}}
+	if restoreJoinLobby(context.Background(), c, ClientMessage{ID: "1", Action: "join_lobby"}) {
+		t.Error("restoreJoinLobby without args = true, want false")
+	}
+}
+
+func TestIdempotentSkipsServerIDs(t *testing.T) {
+	// A nil Redis client panics if Idempotent tries to remember anything.
+	c := &Connection{rm: &db.RedisManager{}, codec: JSONCodec, cfg: Config{}.withDefaults()}
+	entries, ok := c.batchEntries(ClientMessage{Action: "batch", Args: []interface{}{
+		map[string]interface{}{"Action": "ping"},
+		map[string]interface{}{"Action": "ping"},
+	}})
+	if !ok {
+		t.Fatal("batchEntries rejected the batch")
+	}
+
+	ran := 0
+	handler := Idempotent()(func(ctx context.Context, c *Connection, packet ClientMessage) { ran++ })
+	for _, entry := range entries {
+		if !entry.serverID {
+			t.Errorf("entry %s not marked as server-made", entry.ID)
+		}
+		handler(context.Background(), c, entry)
+	}
+	if ran != len(entries) {
+		t.Errorf("ran %d entries, want %d", ran, len(entries))
+	}
+}
+
+func TestIdempotencyRecordNested(t *testing.T) {
+	resp := &ServerResponse{ID: "b1", Type: "response", Status: "ok", Result: []ServerResponse{
+		{ID: "1", Type: "response", Status: "ok", Result: map[string]interface{}{"lobby_id": "abc"}},
+	}}
+	data, err := json.Marshal(newIdempotencyRecord("batch", resp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec idempotencyRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatal(err)
+	}
+
+	// A replayed batch reply is translated like the original one.
+	got, err := JSONCodecV2.Marshal(rec.response())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":"b1","type":"response","status":"ok","result":[` +
+		`{"id":"1","type":"response","status":"ok","result":{"lobby_id":"abc"}}]}`
+	assertJSONEqual(t, "replayed batch", got, want)
+}
+
+func TestScriptActionRedisError(t *testing.T) {
+	mr, rm := newTestRedis(t, db.EventBacklog{})
+	s := NewServer(context.Background(), rm, nil, Config{})
+	t.Cleanup(func() { s.Close() })
+	alice := serveTest(t, s)(auth.User{ID: 1, Username: "alice", Role: auth.RoleUser})
+
+	// HSET on a string fails inside the script; the raw Redis error must
+	// not reach the client, and the retryable reply is not remembered.
+	mr.Set("data:1", "not a hash")
+	alice.send(`{"Id":"a","Action":"addData","Args":["add","score","10"]}`)
+	resp := alice.response("a")
+	e, _ := resp["error"].(map[string]interface{})
+	if e["code"] != string(errcode.Internal) || e["retryable"] != true {
+		t.Fatalf("got %v, want a retryable internal_error", resp)
+	}
+
+	mr.Del("data:1")
+	alice.send(`{"Id":"a","Action":"addData","Args":["add","score","10"]}`)
+	if resp := alice.response("a"); resp["Status"] != "ok" {
+		t.Errorf("retry got %v, want ok", resp)
+	}
+}
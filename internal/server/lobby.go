@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"go-server/internal/db"
+	"go-server/internal/server/errcode"
+
+	gonanoid "github.com/matoous/go-nanoid/v2"
+)
+
+// Every lobby action is a single script call, so all of them can also run
+// in transactions, e.g. to create, configure and join a lobby at once.
+func init() {
+	registerStep("create_lobby", createLobbyStep)
+	registerStep("join_lobby", joinLobbyStep)
+	registerStep("leave_lobby", leaveLobbyStep)
+	OnReplay("join_lobby", restoreJoinLobby)
+
+	// Host-only actions; the scripts check the caller against the lobby's host.
+	registerStep("kick_player", hostStep("kick_player", 2, "lobby id and player id required"))
+	registerStep("set_max_players", hostStep("set_max_players", 2, "lobby id and max players required"))
+	registerStep("lock_lobby", hostStep("set_lobby_locked", 1, "lobby id required", "1"))
+	registerStep("unlock_lobby", hostStep("set_lobby_locked", 1, "lobby id required", "0"))
+	registerStep("close_lobby", hostStep("close_lobby", 1, "lobby id required"))
+}
+
+// Lobby keys and channels. These must match the names used by the lobby
+// scripts in lua_scripts (see create_lobby.lua):
+//
+//	lobby:<id>          hash with the lobby metadata
+//	lobby:<id>:players  hash of player id -> player state JSON
+//	lobby:<id>:events   Pub/Sub channel for every event about the lobby
+
+func LobbyKey(lobbyID string) string {
+	return "lobby:" + lobbyID
+}
+
+func LobbyPlayersKey(lobbyID string) string {
+	return LobbyKey(lobbyID) + ":players"
+}
+
+func LobbyVersionsKey(lobbyID string) string {
+	return LobbyKey(lobbyID) + ":versions"
+}
+
+func LobbyInputsKey(lobbyID string) string {
+	return LobbyKey(lobbyID) + ":inputs"
+}
+
+func LobbyEventsChannel(lobbyID string) string {
+	return LobbyKey(lobbyID) + ":events"
+}
+
+// lobbyOfChannel returns the lobby whose events channel is channel.
+func lobbyOfChannel(channel string) (string, bool) {
+	rest, ok := strings.CutPrefix(channel, LobbyKey(""))
+	if !ok {
+		return "", false
+	}
+	lobbyID, ok := strings.CutSuffix(rest, ":events")
+	return lobbyID, ok && validLobbyID(lobbyID)
+}
+
+// validLobbyID reports whether lobbyID names a single lobby, applying the
+// same rule as the key templates of script manifests.
+func validLobbyID(lobbyID string) bool {
+	return lobbyID != "" && !strings.ContainsAny(lobbyID, ":{}")
+}
+
+// lobbyKeys returns KEYS[1] to KEYS[3] as expected by the lobby scripts, or
+// an invalid_keys error if lobbyID would point them at other keys.
+func lobbyKeys(lobbyID string) ([]string, error) {
+	if !validLobbyID(lobbyID) {
+		return nil, &db.ScriptError{Script: "lobby", Code: string(errcode.InvalidKeys), Message: fmt.Sprintf("invalid lobby id %q", lobbyID)}
+	}
+	return []string{LobbyKey(lobbyID), LobbyPlayersKey(lobbyID), LobbyVersionsKey(lobbyID)}, nil
+}
+
+// createLobbyStep creates a lobby hosted by the caller. The lobby id is
+// chosen up front, so later messages of a transaction can refer to it as
+// "<step>.lobby_id".
+func createLobbyStep(c *Connection, packet ClientMessage) (scriptStep, error) {
+	lobby_id, err := gonanoid.New(5)
+	if err != nil {
+		return scriptStep{}, errcode.New(errcode.Internal, "failed to generate lobby")
+	}
+	// Optional first arg is max players; the caller becomes the host
+	var maxPlayers interface{} = ""
+	if len(packet.Args) > 0 {
+		maxPlayers = packet.Args[0]
+	}
+	return scriptStep{
+		// KEYS[1] = "lobby:<lobbyId>"
+		call:   db.ScriptCall{Script: "create_lobby", Keys: []string{LobbyKey(lobby_id)}, Args: []interface{}{maxPlayers, c.user.Username}},
+		values: map[string]interface{}{"lobby_id": lobby_id},
+		done: func(ctx context.Context, res map[string]interface{}) interface{} {
+			return map[string]string{
+				"lobby_id":       lobby_id,
+				"events_channel": LobbyEventsChannel(lobby_id),
+			}
+		},
+	}, nil
+}
+
+func joinLobbyStep(c *Connection, packet ClientMessage) (scriptStep, error) {
+	if len(packet.Args) < 2 {
+		return scriptStep{}, errcode.New(errcode.MissingArgs, "lobby id required")
+	}
+	lobby_id, _ := packet.Args[0].(string)
+	keys, err := lobbyKeys(lobby_id)
+	if err != nil {
+		return scriptStep{}, err
+	}
+	allArgs := []interface{}{lobby_id, c.user.Username}
+	allArgs = append(allArgs, packet.Args[1:]...)
+
+	return scriptStep{
+		call: db.ScriptCall{Script: "join_lobby", Keys: keys, Args: allArgs},
+		done: func(ctx context.Context, res map[string]interface{}) interface{} {
+			c.joinedLobby(lobby_id)
+			// The snapshot is taken once subscribed, so it covers every
+			// event published since the join; it goes with the join_lobby
+			// response.
+			ack, err := c.subscribe(ctx, LobbyEventsChannel(lobby_id), "")
+			if err != nil {
+				c.sendError("", errcode.SubscribeFailed, err.Error())
+				return res
+			}
+			if snapshot, ok := ack["snapshot"]; ok {
+				res["snapshot"] = snapshot
+				delete(ack, "snapshot")
+			}
+			c.sendResponse("", ack)
+			return res
+		},
+	}, nil
+}
+
+// restoreJoinLobby subscribes a connection that resent a join_lobby which
+// already succeeded, possibly on a connection that has since closed. If the
+// player left the lobby in between, e.g. because that connection closed,
+// join_lobby runs again.
+func restoreJoinLobby(ctx context.Context, c *Connection, packet ClientMessage) bool {
+	if len(packet.Args) < 1 {
+		// join_lobby itself rejects the message.
+		return false
+	}
+	lobby_id, _ := packet.Args[0].(string)
+	member, err := c.rm.Client.HExists(ctx, LobbyPlayersKey(lobby_id), c.user.Username).Result()
+	if err != nil || !member {
+		return false
+	}
+	c.joinedLobby(lobby_id)
+	c.handleSubscribe(ctx, "", LobbyEventsChannel(lobby_id), "")
+	return true
+}
+
+func leaveLobbyStep(c *Connection, packet ClientMessage) (scriptStep, error) {
+	if len(packet.Args) < 1 {
+		return scriptStep{}, errcode.New(errcode.MissingArgs, "lobby id required")
+	}
+	lobby_id, _ := packet.Args[0].(string)
+	keys, err := lobbyKeys(lobby_id)
+	if err != nil {
+		return scriptStep{}, err
+	}
+	return scriptStep{
+		call: db.ScriptCall{Script: "leave_lobby", Keys: keys, Args: []interface{}{lobby_id, c.user.Username}},
+		done: func(ctx context.Context, res map[string]interface{}) interface{} {
+			c.dropLobby(ctx, lobby_id)
+			return res
+		},
+	}, nil
+}
+
+// hostStep returns the binder of a host-only lobby script, which needs
+// nargs client args. The script is called with ARGV = lobbyId, caller,
+// fixedArgs..., remaining client args.
+func hostStep(script string, nargs int, msg string, fixedArgs ...interface{}) stepBinder {
+	return func(c *Connection, packet ClientMessage) (scriptStep, error) {
+		if len(packet.Args) < nargs {
+			return scriptStep{}, errcode.New(errcode.MissingArgs, msg)
+		}
+		lobby_id, _ := packet.Args[0].(string)
+		keys, err := lobbyKeys(lobby_id)
+		if err != nil {
+			return scriptStep{}, err
+		}
+
+		allArgs := []interface{}{lobby_id, c.user.Username}
+		allArgs = append(allArgs, fixedArgs...)
+		allArgs = append(allArgs, packet.Args[1:]...)
+		return scriptStep{call: db.ScriptCall{Script: script, Keys: keys, Args: allArgs}}, nil
+	}
+}
+
+// lobbySnapshot returns the lobby hash, the state and version of every
+// player and, with the backlog enabled, the seq of the last event they reflect.
+func (c *Connection) lobbySnapshot(ctx context.Context, lobbyID string) (map[string]interface{}, error) {
+	keys, err := lobbyKeys(lobbyID)
+	if err != nil {
+		return nil, err
+	}
+	if c.rm.HasBacklog() {
+		keys = append(keys, db.BacklogKey(LobbyEventsChannel(lobbyID)))
+	}
+	snapshot, err := c.rm.CallScript(ctx, "lobby_snapshot", keys)
+	if err != nil {
+		return nil, err
+	}
+	delete(snapshot, "status")
+	return snapshot, nil
+}
+
+// leaveLobbyAs runs leave_lobby for player, who may have no connection.
+func leaveLobbyAs(ctx context.Context, rm *db.RedisManager, player, lobbyID string) (map[string]interface{}, error) {
+	keys, err := lobbyKeys(lobbyID)
+	if err != nil {
+		return nil, err
+	}
+	return rm.CallScript(ctx, "leave_lobby", keys, lobbyID, player)
+}
+
+// leaveLobby removes the connection's player from lobbyID and stops
+// listening to the lobby's events.
+func (c *Connection) leaveLobby(ctx context.Context, lobbyID string) (map[string]interface{}, error) {
+	res, err := leaveLobbyAs(ctx, c.rm, c.user.Username, lobbyID)
+	if err != nil {
+		return nil, err
+	}
+	c.dropLobby(ctx, lobbyID)
+	return res, nil
+}
+
+// dropLobby forgets lobbyID and unsubscribes from its events channel.
+func (c *Connection) dropLobby(ctx context.Context, lobbyID string) {
+	c.leftLobby(lobbyID)
+	channel := LobbyEventsChannel(lobbyID)
+	if err := c.router.Unsubscribe(ctx, c, channel); err != nil {
+		log.Printf("unsubscribe %s failed: %v", channel, err)
+	}
+	c.hub.unsubscribed(c, channel)
+}
+
+// removedFromLobby drops a lobby the player was kicked from or that was
+// closed. The scripts already removed the player in Redis.
+func (c *Connection) removedFromLobby(lobbyID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	c.dropLobby(ctx, lobbyID)
+}
+
+// lobbyRemoval reports whether ev, published on channel, removes players
+// from a lobby: player_kicked removes player, lobby_closed everyone, in
+// which case player is empty.
+func lobbyRemoval(channel string, ev *event) (lobbyID, player string, ok bool) {
+	lobbyID, ok = lobbyOfChannel(channel)
+	if !ok || !(bytes.Contains(ev.data, []byte("player_kicked")) || bytes.Contains(ev.data, []byte("lobby_closed"))) {
+		return "", "", false
+	}
+	var evt struct {
+		Type     string `json:"type"`
+		PlayerID string `json:"player_id"`
+	}
+	if json.Unmarshal(ev.data, &evt) != nil {
+		return "", "", false
+	}
+	switch evt.Type {
+	case "player_kicked":
+		return lobbyID, evt.PlayerID, evt.PlayerID != ""
+	case "lobby_closed":
+		return lobbyID, "", true
+	}
+	return "", "", false
+}
+
+// leaveAllLobbies runs leave_lobby for every lobby the connection joined.
+// It is called when the socket closes, so players don't linger in lobbies.
+func (c *Connection) leaveAllLobbies(ctx context.Context) {
+	for _, lobbyID := range c.joinedLobbies() {
+		if _, err := c.leaveLobby(ctx, lobbyID); err != nil {
+			log.Printf("leave_lobby %s on disconnect failed: %v", lobbyID, err)
+			c.leftLobby(lobbyID)
+		}
+	}
+}
+
+func (c *Connection) joinedLobby(lobbyID string) {
+	c.mu.Lock()
+	_, ok := c.lobbies[lobbyID]
+	c.lobbies[lobbyID] = struct{}{}
+	c.mu.Unlock()
+	if !ok && c.ticks != nil {
+		c.ticks.join(lobbyID)
+	}
+}
+
+func (c *Connection) leftLobby(lobbyID string) {
+	c.mu.Lock()
+	_, ok := c.lobbies[lobbyID]
+	delete(c.lobbies, lobbyID)
+	c.mu.Unlock()
+	if ok && c.ticks != nil {
+		c.ticks.leave(lobbyID)
+	}
+}
+
+func (c *Connection) joinedLobbies() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(c.lobbies))
+	for id := range c.lobbies {
+		ids = append(ids, id)
+	}
+	return ids
+}
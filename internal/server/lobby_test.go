@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"go-server/internal/db"
+)
+
+func TestLobbyKeys(t *testing.T) {
+	tests := []struct {
+		lobbyID string
+		ok      bool
+	}{
+		{"abc", true},
+		{"a-b_c", true},
+		{"", false},
+		{"x:players", false},
+		{"x:", false},
+		{"{x}", false},
+	}
+	for _, tt := range tests {
+		keys, err := lobbyKeys(tt.lobbyID)
+		if !tt.ok {
+			var scriptErr *db.ScriptError
+			if !errors.As(err, &scriptErr) || scriptErr.Code != "invalid_keys" {
+				t.Errorf("lobbyKeys(%q) error = %v, want invalid_keys", tt.lobbyID, err)
+			}
+			continue
+		}
+		want := []string{"lobby:" + tt.lobbyID, "lobby:" + tt.lobbyID + ":players", "lobby:" + tt.lobbyID + ":versions"}
+		if err != nil || !slices.Equal(keys, want) {
+			t.Errorf("lobbyKeys(%q) = %q, %v; want %q", tt.lobbyID, keys, err, want)
+		}
+	}
+}
+
+func TestJoinLobbyHostHandover(t *testing.T) {
+	tests := []struct {
+		name  string
+		joins []string
+		host  string
+	}{
+		{"creator joins first", []string{"alice", "bob"}, "alice"},
+		{"creator never joins", []string{"bob", "carol"}, "bob"},
+		{"creator joins late", []string{"bob", "alice"}, "bob"},
+	}
+	for _, tt := range tests {
+		_, rm := newTestRedis(t, db.EventBacklog{})
+		ctx := context.Background()
+		if _, err := rm.CallScript(ctx, "create_lobby", []string{LobbyKey("abc")}, "", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		keys, _ := lobbyKeys("abc")
+		for _, player := range tt.joins {
+			if _, err := rm.CallScript(ctx, "join_lobby", keys, "abc", player, "{}"); err != nil {
+				t.Fatalf("%s: join %s: %v", tt.name, player, err)
+			}
+		}
+		if host := rm.Client.HGet(ctx, LobbyKey("abc"), "host").Val(); host != tt.host {
+			t.Errorf("%s: host = %q, want %q", tt.name, host, tt.host)
+		}
+
+		// The host can always be migrated once it leaves.
+		if _, err := leaveLobbyAs(ctx, rm, tt.host, "abc"); err != nil {
+			t.Fatalf("%s: leave: %v", tt.name, err)
+		}
+		if host := rm.Client.HGet(ctx, LobbyKey("abc"), "host").Val(); host == tt.host {
+			t.Errorf("%s: host %s kept after leaving", tt.name, host)
+		}
+	}
+}
+
+func TestUpdateState(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  string
+		change   string
+		expected interface{} // version the update is based on
+		mode     string
+		want     string // state afterwards
+		code     string // of the error, if any
+	}{
+		{"replace", `{"x":1}`, `{"x":2}`, "", "", `{"x":2}`, ""},
+		{"merge", `{"x":1,"pos":{"y":2}}`, `{"pos":{"z":3}}`, "", "merge", `{"x":1,"pos":{"y":2,"z":3}}`, ""},
+		{"merge keeps empty containers", `{"a":[],"o":{}}`, `{"x":1}`, "", "merge", `{"a":[],"o":{},"x":1}`, ""},
+		{"merge an empty array", `{"a":[1]}`, `{"a":[]}`, "", "merge", `{"a":[]}`, ""},
+		{"set", `{"pos":{"x":1}}`, `[{"op":"set","path":"pos.x","value":6},{"op":"set","path":"new.deep","value":[]}]`, "", "set",
+			`{"pos":{"x":6},"new":{"deep":[]}}`, ""},
+		{"unset", `{"a":1,"shield":{"hp":3}}`, `[{"op":"unset","path":"shield"},{"op":"unset","path":"missing.path"}]`, "", "set", `{"a":1}`, ""},
+		{"unset the last field", `{"o":{"k":1}}`, `[{"op":"unset","path":"o.k"}]`, "", "set", `{"o":{}}`, ""},
+		{"no ops", `{"a":[]}`, `[]`, "", "set", `{"a":[]}`, ""},
+		{"set through an array", `{"items":[1,2,3]}`, `[{"op":"set","path":"items.1","value":9}]`, "", "set", `{"items":[1,2,3]}`, "invalid_args"},
+		{"unknown op", `{"a":1}`, `[{"op":"add","path":"a","value":2}]`, "", "set", `{"a":1}`, "invalid_args"},
+		{"unknown mode", `{"a":1}`, `{"a":2}`, "", "patch", `{"a":1}`, "invalid_args"},
+		{"current version", `{"a":1}`, `{"a":2}`, 1, "merge", `{"a":2}`, ""},
+		{"version conflict", `{"a":1}`, `{"a":2}`, 5, "merge", `{"a":1}`, "version_conflict"},
+	}
+	for _, tt := range tests {
+		mr, rm := newTestRedis(t, db.EventBacklog{})
+		ctx := context.Background()
+		if _, err := rm.CallScript(ctx, "create_lobby", []string{LobbyKey("abc")}, "", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		keys, _ := lobbyKeys("abc")
+		if _, err := rm.CallScript(ctx, "join_lobby", keys, "abc", "alice", tt.initial); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := rm.CallScript(ctx, "update_state", keys, "abc", "alice", tt.change, tt.expected, tt.mode)
+		var scriptErr *db.ScriptError
+		switch {
+		case tt.code == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.code != "" && (!errors.As(err, &scriptErr) || scriptErr.Code != tt.code):
+			t.Errorf("%s: error = %v, want %s", tt.name, err, tt.code)
+		case tt.code == "" && res["version"] != float64(2):
+			t.Errorf("%s: version = %v, want 2", tt.name, res["version"])
+		}
+		if tt.code == "version_conflict" {
+			details, _ := scriptErr.Details.(map[string]interface{})
+			if details["version"] != float64(1) {
+				t.Errorf("%s: details = %v, want version 1", tt.name, scriptErr.Details)
+			}
+		}
+		assertJSONEqual(t, tt.name, []byte(mr.HGet(LobbyPlayersKey("abc"), "alice")), tt.want)
+	}
+}
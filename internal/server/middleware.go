@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go-server/internal/server/errcode"
+)
+
+// Logging logs every action with the calling user and how long it took.
+func Logging() Middleware {
+	return func(next ActionHandler) ActionHandler {
+		return func(ctx context.Context, c *Connection, packet ClientMessage) {
+			start := time.Now()
+			next(ctx, c, packet)
+			log.Printf("action=%s id=%s user=%s took=%s", packet.Action, packet.ID, c.user.Username, time.Since(start))
+		}
+	}
+}
+
+// RequireArgs rejects packets with fewer than n Args.
+func RequireArgs(n int, msg string) Middleware {
+	return func(next ActionHandler) ActionHandler {
+		return func(ctx context.Context, c *Connection, packet ClientMessage) {
+			if len(packet.Args) < n {
+				c.sendError(packet.ID, errcode.MissingArgs, msg)
+				return
+			}
+			next(ctx, c, packet)
+		}
+	}
+}
+
+// RequireKeys rejects packets without Keys or with an empty key.
+func RequireKeys() Middleware {
+	return func(next ActionHandler) ActionHandler {
+		return func(ctx context.Context, c *Connection, packet ClientMessage) {
+			if len(packet.Keys) < 1 {
+				c.sendError(packet.ID, errcode.InvalidKeys, "missing Redis keys")
+				return
+			}
+			for _, k := range packet.Keys {
+				if k == "" {
+					c.sendError(packet.ID, errcode.InvalidKeys, "all keys must be non-empty strings")
+					return
+				}
+			}
+			next(ctx, c, packet)
+		}
+	}
+}
+
+// AuthorizeChannel checks the channel in Args[0] against the connection's
+// ChannelPolicy. It must run after RequireArgs(1, ...).
+func AuthorizeChannel() Middleware {
+	return func(next ActionHandler) ActionHandler {
+		return func(ctx context.Context, c *Connection, packet ClientMessage) {
+			channel, _ := packet.Args[0].(string)
+			ok, err := c.cfg.ChannelPolicy.CanSubscribe(ctx, c.rm, c.user, channel)
+			if err != nil {
+				log.Printf("channel policy check for %s failed: %v", channel, err)
+				c.sendError(packet.ID, errcode.Internal, "failed to authorize channel")
+				return
+			}
+			if !ok {
+				c.sendError(packet.ID, errcode.Forbidden, "not allowed to subscribe to "+channel)
+				return
+			}
+			next(ctx, c, packet)
+		}
+	}
+}
+
+// RequireRegistered rejects guest users.
+func RequireRegistered() Middleware {
+	return func(next ActionHandler) ActionHandler {
+		return func(ctx context.Context, c *Connection, packet ClientMessage) {
+			if c.user.IsGuest {
+				c.sendError(packet.ID, errcode.Unauthorized, "registered account required")
+				return
+			}
+			next(ctx, c, packet)
+		}
+	}
+}
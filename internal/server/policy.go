@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"go-server/internal/auth"
+	"go-server/internal/db"
+)
+
+// Conditions a ChannelRule can require, in addition to its roles.
+const (
+	AllowAny         = "any"          // any authenticated user, guests included
+	AllowRegistered  = "registered"   // non-guest users only
+	AllowLobbyMember = "lobby_member" // members of the lobby named by {lobby_id}
+	AllowSelf        = "self"         // the registered user whose ID is {user_id}
+	AllowNone        = "none"         // nobody
+)
+
+// ChannelRule grants or denies subscriptions to channels matching Pattern.
+// Patterns are ':'-separated segments where "{name}" captures one segment
+// and a trailing "*" matches the rest, e.g. "lobby:{lobby_id}:events" or
+// "admin:*".
+type ChannelRule struct {
+	Pattern string   `json:"pattern"`
+	Allow   string   `json:"allow"`
+	Roles   []string `json:"roles,omitempty"` // if set, the user needs one of them
+}
+
+// ChannelPolicy decides whether a user may subscribe to a channel. Rules are
+// checked in order and the first matching rule decides; channels matching
+// no rule fall back to Default.
+type ChannelPolicy struct {
+	Default string        `json:"default"`
+	Rules   []ChannelRule `json:"rules"`
+}
+
+// DefaultChannelPolicy lets lobby members follow their lobby's events and
+// users the events of their own data (see addData.lua), keeps admin
+// channels to admins and denies everything else.
+func DefaultChannelPolicy() *ChannelPolicy {
+	return &ChannelPolicy{
+		Default: AllowNone,
+		Rules: []ChannelRule{
+			{Pattern: "lobby:{lobby_id}:events", Allow: AllowLobbyMember},
+			{Pattern: "data:{user_id}:events", Allow: AllowSelf},
+			{Pattern: "admin:*", Allow: AllowAny, Roles: []string{auth.RoleAdmin}},
+		},
+	}
+}
+
+// LoadChannelPolicy reads a ChannelPolicy from a JSON file. A missing file
+// gives an error matching fs.ErrNotExist.
+func LoadChannelPolicy(path string) (*ChannelPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read channel policy: %w", err)
+	}
+	var p ChannelPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse channel policy: %v", err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate checks that every rule uses a known condition.
+func (p *ChannelPolicy) Validate() error {
+	if !knownCondition(p.Default) {
+		return fmt.Errorf("invalid default %q", p.Default)
+	}
+	for _, r := range p.Rules {
+		if r.Pattern == "" {
+			return fmt.Errorf("rule without pattern")
+		}
+		if !knownCondition(r.Allow) {
+			return fmt.Errorf("rule %s: invalid allow %q", r.Pattern, r.Allow)
+		}
+		if r.Allow == AllowLobbyMember && !strings.Contains(r.Pattern, "{lobby_id}") {
+			return fmt.Errorf("rule %s: %s requires a {lobby_id} segment", r.Pattern, AllowLobbyMember)
+		}
+		if r.Allow == AllowSelf && !strings.Contains(r.Pattern, "{user_id}") {
+			return fmt.Errorf("rule %s: %s requires a {user_id} segment", r.Pattern, AllowSelf)
+		}
+	}
+	return nil
+}
+
+// CanSubscribe reports whether user may subscribe to channel.
+func (p *ChannelPolicy) CanSubscribe(ctx context.Context, rm *db.RedisManager, user auth.User, channel string) (bool, error) {
+	for _, r := range p.Rules {
+		vars, ok := matchChannel(r.Pattern, channel)
+		if !ok {
+			continue
+		}
+		if len(r.Roles) > 0 && !user.HasRole(r.Roles...) {
+			return false, nil
+		}
+		return allowed(ctx, rm, r.Allow, user, vars)
+	}
+	return allowed(ctx, rm, p.Default, user, nil)
+}
+
+func allowed(ctx context.Context, rm *db.RedisManager, condition string, user auth.User, vars map[string]string) (bool, error) {
+	switch condition {
+	case AllowAny:
+		return true, nil
+	case AllowRegistered:
+		return !user.IsGuest, nil
+	case AllowLobbyMember:
+		return rm.Client.HExists(ctx, LobbyPlayersKey(vars["lobby_id"]), user.Username).Result()
+	case AllowSelf:
+		// Guests share an ID, so no guest owns a channel.
+		return !user.IsGuest && vars["user_id"] == strconv.Itoa(user.ID), nil
+	default:
+		return false, nil
+	}
+}
+
+func knownCondition(c string) bool {
+	switch c {
+	case AllowAny, AllowRegistered, AllowLobbyMember, AllowSelf, AllowNone:
+		return true
+	}
+	return false
+}
+
+// matchChannel matches channel against pattern and returns the captured
+// "{name}" segments.
+func matchChannel(pattern, channel string) (map[string]string, bool) {
+	pp := strings.Split(pattern, ":")
+	cp := strings.Split(channel, ":")
+	vars := make(map[string]string)
+	for i, seg := range pp {
+		if seg == "*" && i == len(pp)-1 {
+			return vars, len(cp) > i
+		}
+		if i >= len(cp) {
+			return nil, false
+		}
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if cp[i] == "" {
+				return nil, false
+			}
+			vars[seg[1:len(seg)-1]] = cp[i]
+			continue
+		}
+		if seg != cp[i] {
+			return nil, false
+		}
+	}
+	return vars, len(pp) == len(cp)
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-server/internal/auth"
+)
+
+func TestMatchChannel(t *testing.T) {
+	tests := []struct {
+		pattern, channel string
+		ok               bool
+		vars             map[string]string
+	}{
+		{"lobby:{lobby_id}:events", "lobby:abc:events", true, map[string]string{"lobby_id": "abc"}},
+		{"lobby:{lobby_id}:events", "lobby::events", false, nil},
+		{"lobby:{lobby_id}:events", "lobby:abc:events:x", false, nil},
+		{"lobby:{lobby_id}:events", "lobby:abc", false, nil},
+		{"lobby:{lobby_id}:events", "lobby:abc:players", false, nil},
+		{"lobby:{lobby_id}:events", "other:abc:events", false, nil},
+		{"admin:*", "admin:alerts", true, map[string]string{}},
+		{"admin:*", "admin:alerts:high", true, map[string]string{}},
+		{"admin:*", "admin", false, nil},
+		{"admin:*", "administrator:x", false, nil},
+		{"news", "news", true, map[string]string{}},
+		{"news", "news:sports", false, nil},
+		{"{a}:{b}", "x:y", true, map[string]string{"a": "x", "b": "y"}},
+	}
+	for _, tt := range tests {
+		vars, ok := matchChannel(tt.pattern, tt.channel)
+		if ok != tt.ok {
+			t.Errorf("matchChannel(%q, %q) = %v, want %v", tt.pattern, tt.channel, ok, tt.ok)
+			continue
+		}
+		if ok && !maps.Equal(vars, tt.vars) {
+			t.Errorf("matchChannel(%q, %q) vars = %v, want %v", tt.pattern, tt.channel, vars, tt.vars)
+		}
+	}
+}
+
+func TestCanSubscribe(t *testing.T) {
+	policy := &ChannelPolicy{
+		Default: AllowNone,
+		Rules: []ChannelRule{
+			{Pattern: "admin:*", Allow: AllowAny, Roles: []string{auth.RoleAdmin}},
+			{Pattern: "chat:{room}", Allow: AllowRegistered},
+			{Pattern: "data:{user_id}:events", Allow: AllowSelf},
+			{Pattern: "news:*", Allow: AllowAny},
+			{Pattern: "news:secret", Allow: AllowNone}, // shadowed by news:*
+			// Role checks come first, so this never reaches Redis.
+			{Pattern: "staff:{lobby_id}:events", Allow: AllowLobbyMember, Roles: []string{auth.RoleAdmin}},
+		},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	guest := auth.User{ID: -1, Username: "Guest_1", IsGuest: true, Role: auth.RoleGuest}
+	user := auth.User{ID: 1, Username: "alice", Role: auth.RoleUser}
+	admin := auth.User{ID: 2, Username: "root", Role: auth.RoleAdmin}
+
+	tests := []struct {
+		user    auth.User
+		channel string
+		want    bool
+	}{
+		{admin, "admin:alerts", true},
+		{user, "admin:alerts", false},
+		{guest, "admin:alerts", false},
+		{user, "chat:general", true},
+		{guest, "chat:general", false},
+		{guest, "news:sports", true},
+		{guest, "news:secret", true},
+		{user, "staff:abc:events", false},
+		{user, "data:1:events", true},
+		{user, "data:2:events", false},
+		{guest, "data:-1:events", false},
+		{admin, "unknown", false},
+		{admin, "", false},
+	}
+	for _, tt := range tests {
+		got, err := policy.CanSubscribe(context.Background(), nil, tt.user, tt.channel)
+		if err != nil {
+			t.Errorf("CanSubscribe(%s, %q): %v", tt.user.Username, tt.channel, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("CanSubscribe(%s, %q) = %v, want %v", tt.user.Username, tt.channel, got, tt.want)
+		}
+	}
+}
+
+func TestLoadChannelPolicy(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		name     string
+		path     string
+		ok       bool
+		notExist bool
+	}{
+		{"shipped", "../../config/channel_policy.json", true, false},
+		{"missing", filepath.Join(dir, "missing.json"), false, true},
+		{"malformed", write("bad.json", `{"default": "none",`), false, false},
+		{"invalid", write("invalid.json", `{"default": "everyone"}`), false, false},
+	}
+	for _, tt := range tests {
+		_, err := LoadChannelPolicy(tt.path)
+		if (err == nil) != tt.ok || errors.Is(err, fs.ErrNotExist) != tt.notExist {
+			t.Errorf("%s: LoadChannelPolicy error = %v", tt.name, err)
+		}
+	}
+}
+
+func TestChannelPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ChannelPolicy
+		ok     bool
+	}{
+		{"default", *DefaultChannelPolicy(), true},
+		{"unknown default", ChannelPolicy{Default: "everyone"}, false},
+		{"empty default", ChannelPolicy{}, false},
+		{"no pattern", ChannelPolicy{Default: AllowNone, Rules: []ChannelRule{{Allow: AllowAny}}}, false},
+		{"unknown allow", ChannelPolicy{Default: AllowNone, Rules: []ChannelRule{{Pattern: "x", Allow: "all"}}}, false},
+		{"self without user", ChannelPolicy{Default: AllowNone, Rules: []ChannelRule{{Pattern: "data:{id}", Allow: AllowSelf}}}, false},
+		{"member without lobby", ChannelPolicy{Default: AllowNone, Rules: []ChannelRule{{Pattern: "room:{id}", Allow: AllowLobbyMember}}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
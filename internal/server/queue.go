@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// OverflowPolicy decides what a SendQueue does with broadcast traffic once
+// it holds Limit messages.
+type OverflowPolicy string
+
+const (
+	DropOldest OverflowPolicy = "drop_oldest" // discard the oldest queued event
+	DropNewest OverflowPolicy = "drop_newest" // discard the incoming event
+	Coalesce   OverflowPolicy = "coalesce"    // replace a queued event with the same key, else drop oldest
+	Disconnect OverflowPolicy = "disconnect"  // close the connection
+)
+
+// ParseOverflowPolicy validates a policy name, e.g. from configuration.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case DropOldest, DropNewest, Coalesce, Disconnect:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q", s)
+}
+
+// outMsg is one outbound frame. Critical messages are responses to the
+// client's own requests: they are sent before any queued event and are
+// never dropped to make room for broadcast traffic.
+type outMsg struct {
+	data     []byte
+	critical bool
+	key      string // coalescing key for events, empty if none
+}
+
+// QueueStats is a snapshot of a SendQueue.
+type QueueStats struct {
+	Depth     int    `json:"depth"`     // messages waiting to be written
+	Dropped   uint64 `json:"dropped"`   // events discarded by the overflow policy
+	Coalesced uint64 `json:"coalesced"` // events replaced by a newer one with the same key
+}
+
+// SendQueue is the outbound queue of a Connection. Push never blocks, so a
+// slow client cannot stall the subscription router or its own ReadPump.
+type SendQueue struct {
+	mu        sync.Mutex
+	critical  [][]byte
+	events    []outMsg
+	limit     int
+	policy    OverflowPolicy
+	overflow  func() // called once when the client must be disconnected
+	notify    chan struct{}
+	closed    bool
+	dropped   uint64
+	coalesced uint64
+}
+
+func NewSendQueue(limit int, policy OverflowPolicy, overflow func()) *SendQueue {
+	return &SendQueue{
+		limit:    limit,
+		policy:   policy,
+		overflow: overflow,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// Push queues msg and reports whether it was accepted.
+func (q *SendQueue) Push(msg outMsg) bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+
+	accepted := true
+	disconnect := false
+	switch {
+	case msg.critical:
+		// Critical messages are never dropped, so a client that does not
+		// even read its own responses is disconnected instead.
+		if len(q.critical) >= q.limit {
+			accepted, disconnect = false, true
+		} else {
+			q.critical = append(q.critical, msg.data)
+		}
+	case len(q.events) < q.limit:
+		q.events = append(q.events, msg)
+	default:
+		accepted, disconnect = q.overflowLocked(msg)
+	}
+
+	if disconnect {
+		q.closed = true
+	}
+	q.mu.Unlock()
+
+	if disconnect && q.overflow != nil {
+		q.overflow()
+	}
+	if accepted {
+		q.wake()
+	}
+	return accepted
+}
+
+// overflowLocked applies the policy to msg arriving at a full event queue.
+func (q *SendQueue) overflowLocked(msg outMsg) (accepted, disconnect bool) {
+	switch q.policy {
+	case DropNewest:
+		q.dropped++
+		return false, false
+	case Disconnect:
+		return false, true
+	case Coalesce:
+		if msg.key != "" {
+			for i := range q.events {
+				if q.events[i].key == msg.key {
+					q.events[i] = msg
+					q.coalesced++
+					return true, false
+				}
+			}
+		}
+	}
+	// DropOldest, and Coalesce without a matching key
+	q.events = append(q.events[1:], msg)
+	q.dropped++
+	return true, false
+}
+
+func (q *SendQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pop waits for the next message, critical ones first. It returns false
+// once ctx is done or the queue is closed and empty.
+func (q *SendQueue) Pop(ctx context.Context) ([]byte, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.critical) > 0 {
+			data := q.critical[0]
+			q.critical[0] = nil
+			q.critical = q.critical[1:]
+			q.mu.Unlock()
+			return data, true
+		}
+		if len(q.events) > 0 {
+			msg := q.events[0]
+			q.events[0] = outMsg{}
+			q.events = q.events[1:]
+			q.mu.Unlock()
+			return msg.data, true
+		}
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+
+		select {
+		case <-q.notify:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// Close rejects further pushes and wakes a waiting Pop. Queued messages can
+// still be popped.
+func (q *SendQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.wake()
+}
+
+// drain discards every queued message and returns how many there were.
+func (q *SendQueue) drain() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.critical) + len(q.events)
+	q.critical = nil
+	q.events = nil
+	return n
+}
+
+func (q *SendQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Depth:     len(q.critical) + len(q.events),
+		Dropped:   q.dropped,
+		Coalesced: q.coalesced,
+	}
+}
+
+// eventKey returns the coalescing key of a pushed event: events of the same
+// type about the same player on the same channel supersede each other.
+// Events without a type are never coalesced, nor are deltas (events with a
+// "patch" or "ops"), since each builds on the one before, nor ticks, whose
+// snapshots only hold the players that changed.
+func eventKey(channel string, payload []byte) string {
+	var evt struct {
+		Type     string          `json:"type"`
+		PlayerID string          `json:"player_id"`
+		Patch    json.RawMessage `json:"patch"`
+		Ops      json.RawMessage `json:"ops"`
+	}
+	if json.Unmarshal(payload, &evt) != nil || evt.Type == "" || evt.Type == "tick" || evt.Patch != nil || evt.Ops != nil {
+		return ""
+	}
+	return channel + "|" + evt.Type + "|" + evt.PlayerID
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestSendQueueOverflow(t *testing.T) {
+	ev := func(data, key string) outMsg { return outMsg{data: []byte(data), key: key} }
+	tests := []struct {
+		policy      OverflowPolicy
+		push        []outMsg
+		accepted    []bool
+		want        []string
+		stats       QueueStats
+		disconnects int
+	}{
+		{
+			policy:   DropOldest,
+			push:     []outMsg{ev("1", ""), ev("2", ""), ev("3", "")},
+			accepted: []bool{true, true, true},
+			want:     []string{"2", "3"},
+			stats:    QueueStats{Depth: 2, Dropped: 1},
+		},
+		{
+			policy:   DropNewest,
+			push:     []outMsg{ev("1", ""), ev("2", ""), ev("3", "")},
+			accepted: []bool{true, true, false},
+			want:     []string{"1", "2"},
+			stats:    QueueStats{Depth: 2, Dropped: 1},
+		},
+		{
+			policy:   Coalesce,
+			push:     []outMsg{ev("a1", "a"), ev("b1", "b"), ev("a2", "a")},
+			accepted: []bool{true, true, true},
+			want:     []string{"a2", "b1"},
+			stats:    QueueStats{Depth: 2, Coalesced: 1},
+		},
+		{
+			// Without a matching key, coalesce falls back to drop oldest.
+			policy:   Coalesce,
+			push:     []outMsg{ev("a1", "a"), ev("b1", "b"), ev("c1", "c"), ev("x", "")},
+			accepted: []bool{true, true, true, true},
+			want:     []string{"c1", "x"},
+			stats:    QueueStats{Depth: 2, Dropped: 2},
+		},
+		{
+			policy:      Disconnect,
+			push:        []outMsg{ev("1", ""), ev("2", ""), ev("3", ""), ev("4", "")},
+			accepted:    []bool{true, true, false, false},
+			want:        []string{"1", "2"},
+			stats:       QueueStats{Depth: 2},
+			disconnects: 1,
+		},
+	}
+	for _, tt := range tests {
+		disconnects := 0
+		q := NewSendQueue(2, tt.policy, func() { disconnects++ })
+		for i, msg := range tt.push {
+			if got := q.Push(msg); got != tt.accepted[i] {
+				t.Errorf("%s: Push(%s) = %v, want %v", tt.policy, msg.data, got, tt.accepted[i])
+			}
+		}
+		if got := q.Stats(); got != tt.stats {
+			t.Errorf("%s: Stats() = %+v, want %+v", tt.policy, got, tt.stats)
+		}
+		if got := popAll(q); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: popped %q, want %q", tt.policy, got, tt.want)
+		}
+		if disconnects != tt.disconnects {
+			t.Errorf("%s: overflow called %d times, want %d", tt.policy, disconnects, tt.disconnects)
+		}
+	}
+}
+
+func TestSendQueueCritical(t *testing.T) {
+	disconnects := 0
+	q := NewSendQueue(2, DropNewest, func() { disconnects++ })
+	q.Push(outMsg{data: []byte("e1")})
+	q.Push(outMsg{data: []byte("e2")})
+	// Responses go out first and don't count against the event limit.
+	if !q.Push(outMsg{data: []byte("r1"), critical: true}) {
+		t.Fatal("critical message rejected by a full event queue")
+	}
+	if got, want := popAll(q), []string{"r1", "e1", "e2"}; !slices.Equal(got, want) {
+		t.Fatalf("popped %q, want %q", got, want)
+	}
+
+	// A client that doesn't read its own responses is disconnected.
+	q.Push(outMsg{data: []byte("r2"), critical: true})
+	q.Push(outMsg{data: []byte("r3"), critical: true})
+	if q.Push(outMsg{data: []byte("r4"), critical: true}) {
+		t.Error("critical message accepted beyond the limit")
+	}
+	if disconnects != 1 {
+		t.Errorf("overflow called %d times, want 1", disconnects)
+	}
+	if q.Push(outMsg{data: []byte("e3")}) {
+		t.Error("push accepted after overflow closed the queue")
+	}
+}
+
+func TestSendQueueClose(t *testing.T) {
+	q := NewSendQueue(2, DropOldest, nil)
+	q.Push(outMsg{data: []byte("1")})
+	q.Close()
+	if q.Push(outMsg{data: []byte("2")}) {
+		t.Error("push accepted after Close")
+	}
+	if data, ok := q.Pop(context.Background()); !ok || string(data) != "1" {
+		t.Errorf("Pop after Close = %q, %v; want queued message", data, ok)
+	}
+	if _, ok := q.Pop(context.Background()); ok {
+		t.Error("Pop of a closed, empty queue succeeded")
+	}
+}
+
+func TestEventKey(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{`{"type":"player_joined","player_id":"bob"}`, "lobby:a:events|player_joined|bob"},
+		{`{"type":"lobby_closed"}`, "lobby:a:events|lobby_closed|"},
+		{`{"type":"player_state_update","player_id":"bob","state":"{}"}`, "lobby:a:events|player_state_update|bob"},
+		{`{"type":"player_state_update","player_id":"bob","patch":"{\"x\":1}"}`, ""},
+		{`{"type":"player_state_update","player_id":"bob","ops":"[]"}`, ""},
+		{`{"type":"tick","lobby_id":"a","tick":3,"snapshot":{}}`, ""},
+		{`{"player_id":"bob"}`, ""},
+		{`not json`, ""},
+	}
+	for _, tt := range tests {
+		if got := eventKey("lobby:a:events", []byte(tt.payload)); got != tt.want {
+			t.Errorf("eventKey(%s) = %q, want %q", tt.payload, got, tt.want)
+		}
+	}
+}
+
+// popAll pops the messages of a queue that will not be pushed to meanwhile.
+func popAll(q *SendQueue) []string {
+	var out []string
+	for q.Stats().Depth > 0 {
+		data, _ := q.Pop(context.Background())
+		out = append(out, string(data))
+	}
+	return out
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"sync"
+
+	"go-server/internal/server/errcode"
+)
+
+// ActionHandler handles a single client action received on a Connection.
+type ActionHandler func(ctx context.Context, c *Connection, packet ClientMessage)
+
+// Middleware wraps an ActionHandler, e.g. to add auth, validation or logging.
+type Middleware func(next ActionHandler) ActionHandler
+
+// ActionRegistry maps action names to Go handlers. Actions without a
+// registered handler are passed to the fallback, which by default calls
+// the Lua script of the same name through RedisManager.CallScript.
+type ActionRegistry struct {
+	mu         sync.RWMutex
+	handlers   map[string]ActionHandler
+	middleware []Middleware
+	fallback   ActionHandler
+}
+
+// Actions is the registry used by ReadPump. Game code registers its
+// actions here, typically from an init function in its own file.
+var Actions = NewActionRegistry()
+
+func NewActionRegistry() *ActionRegistry {
+	return &ActionRegistry{
+		handlers: make(map[string]ActionHandler),
+		fallback: handleScriptAction,
+	}
+}
+
+// Register adds a handler for action. The given middleware only applies to
+// this action and runs inside the registry-wide middleware.
+func (r *ActionRegistry) Register(action string, h ActionHandler, mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[action] = chain(h, mw)
+}
+
+// Unregister removes the handler for action, if any.
+func (r *ActionRegistry) Unregister(action string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.handlers, action)
+}
+
+// Use adds middleware that runs for every action, including the fallback.
+func (r *ActionRegistry) Use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middleware = append(r.middleware, mw...)
+}
+
+// SetFallback replaces the handler for actions with no registered handler.
+func (r *ActionRegistry) SetFallback(h ActionHandler, mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = chain(h, mw)
+}
+
+// Handles reports whether action has a registered handler, as opposed to
+// being passed to the fallback.
+func (r *ActionRegistry) Handles(action string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.handlers[action]
+	return ok
+}
+
+// Dispatch runs the handler registered for packet.Action. A handler that
+// panics gets the client an internal_error instead of taking the
+// connection down.
+func (r *ActionRegistry) Dispatch(ctx context.Context, c *Connection, packet ClientMessage) {
+	r.mu.RLock()
+	h, ok := r.handlers[packet.Action]
+	if !ok {
+		h = r.fallback
+	}
+	h = chain(h, r.middleware)
+	r.mu.RUnlock()
+
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("action %s from %s panicked: %v\n%s", packet.Action, c.user.Username, err, debug.Stack())
+			c.sendError(packet.ID, errcode.Internal, packet.Action+" failed")
+		}
+	}()
+	h(ctx, c, packet)
+}
+
+// chain wraps h so that mw[0] is the outermost middleware.
+func chain(h ActionHandler, mw []Middleware) ActionHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"go-server/internal/server/errcode"
+)
+
+func TestDispatchRecoversPanics(t *testing.T) {
+	r := NewActionRegistry()
+	r.Register("boom", func(ctx context.Context, c *Connection, packet ClientMessage) {
+		var args []interface{}
+		_ = args[0]
+	})
+
+	c := &Connection{}
+	resp := c.capture("1", func() {
+		r.Dispatch(context.Background(), c, ClientMessage{ID: "1", Action: "boom"})
+	})
+	if resp == nil || resp.Status != "error" || resp.Error.Code != errcode.Internal {
+		t.Fatalf("got %+v, want an internal_error response", resp)
+	}
+}
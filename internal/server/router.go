@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SubscriptionRouter multiplexes the Redis Pub/Sub subscriptions of every
+// Connection on this node over a single PubSub connection. Channels are
+// reference counted: Redis is subscribed when the first connection joins a
+// channel and unsubscribed when the last one leaves.
+type SubscriptionRouter struct {
+	source eventSource
+	mu     sync.RWMutex
+	subs   map[string]map[*Connection]struct{} // channel -> subscribers
+	conns  map[*Connection]map[string]struct{} // connection -> channels
+}
+
+// eventSource delivers the events of the channels the router follows.
+type eventSource interface {
+	subscribe(ctx context.Context, channel string) error
+	unsubscribe(ctx context.Context, channel string) error
+	close() error
+}
+
+// cursorSource is an eventSource whose subscriptions start at a cursor
+// looked up in Redis. The router looks it up before taking its lock, so a
+// slow lookup doesn't hold up the delivery of events.
+type cursorSource interface {
+	eventSource
+	lastSeq(ctx context.Context, channel string) (string, error)
+	follow(channel, seq string)
+}
+
+func newRouter() *SubscriptionRouter {
+	return &SubscriptionRouter{
+		subs:  make(map[string]map[*Connection]struct{}),
+		conns: make(map[*Connection]map[string]struct{}),
+	}
+}
+
+func NewSubscriptionRouter(ctx context.Context, client *redis.Client) *SubscriptionRouter {
+	r := newRouter()
+	// Subscribe without channels; they are added on demand.
+	ps := &pubsubSource{pubsub: client.Subscribe(ctx)}
+	go ps.run(r.dispatch)
+	r.source = ps
+	return r
+}
+
+// Subscribe adds c to channel, subscribing in Redis if c is the first
+// subscriber on this node.
+func (r *SubscriptionRouter) Subscribe(ctx context.Context, c *Connection, channel string) error {
+	// A cursor looked up before the lock is at most older than one looked
+	// up under it: no event is missed, at worst a few published just
+	// before the subscription are delivered too.
+	cs, cursored := r.source.(cursorSource)
+	var seq string
+	if cursored && !r.following(channel) {
+		var err error
+		if seq, err = cs.lastSeq(ctx, channel); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	subscribers, ok := r.subs[channel]
+	if !ok {
+		// Without a cursor, e.g. if the last subscriber left since the
+		// check above, the source looks it up itself.
+		if seq != "" {
+			cs.follow(channel, seq)
+		} else if err := r.source.subscribe(ctx, channel); err != nil {
+			return err
+		}
+		subscribers = make(map[*Connection]struct{})
+		r.subs[channel] = subscribers
+	}
+	subscribers[c] = struct{}{}
+
+	if r.conns[c] == nil {
+		r.conns[c] = make(map[string]struct{})
+	}
+	r.conns[c][channel] = struct{}{}
+	return nil
+}
+
+// following reports whether this node follows channel.
+func (r *SubscriptionRouter) following(channel string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.subs[channel]
+	return ok
+}
+
+// Unsubscribe removes c from channel, unsubscribing in Redis if c was the
+// last subscriber on this node.
+func (r *SubscriptionRouter) Unsubscribe(ctx context.Context, c *Connection, channel string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.unsubscribe(ctx, c, channel)
+}
+
+// UnsubscribeAll removes c from every channel it is subscribed to.
+func (r *SubscriptionRouter) UnsubscribeAll(ctx context.Context, c *Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for channel := range r.conns[c] {
+		if err := r.unsubscribe(ctx, c, channel); err != nil {
+			log.Printf("unsubscribe %s failed: %v", channel, err)
+		}
+	}
+}
+
+// Channels returns the channels c is subscribed to.
+func (r *SubscriptionRouter) Channels(c *Connection) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	channels := make([]string, 0, len(r.conns[c]))
+	for channel := range r.conns[c] {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// unsubscribe expects r.mu to be held.
+func (r *SubscriptionRouter) unsubscribe(ctx context.Context, c *Connection, channel string) error {
+	if channels, ok := r.conns[c]; ok {
+		delete(channels, channel)
+		if len(channels) == 0 {
+			delete(r.conns, c)
+		}
+	}
+
+	subscribers, ok := r.subs[channel]
+	if !ok {
+		return nil
+	}
+	delete(subscribers, c)
+	if len(subscribers) > 0 {
+		return nil
+	}
+	delete(r.subs, channel)
+	return r.source.unsubscribe(ctx, channel)
+}
+
+// dispatch fans an event out to the subscribers of channel. Pushing never
+// blocks; a connection whose send queue is full is handled by its overflow
+// policy rather than stalling everyone else. Subscribers the event removes
+// from a lobby stop listening to it once the event is queued.
+func (r *SubscriptionRouter) dispatch(channel string, ev *event) {
+	lobbyID, player, removes := lobbyRemoval(channel, ev)
+	var removed []*Connection
+	r.mu.RLock()
+	for c := range r.subs[channel] {
+		c.pushEvent(channel, ev)
+		if removes && (player == "" || c.user.Username == player) {
+			removed = append(removed, c)
+		}
+	}
+	r.mu.RUnlock()
+	for _, c := range removed {
+		// Not on the reading goroutine: unsubscribing may wait for it.
+		go c.removedFromLobby(lobbyID)
+	}
+}
+
+// Close stops reading events.
+func (r *SubscriptionRouter) Close() error {
+	return r.source.close()
+}
+
+// pubsubSource reads events from a shared PubSub connection.
+type pubsubSource struct {
+	pubsub *redis.PubSub
+}
+
+func (s *pubsubSource) subscribe(ctx context.Context, channel string) error {
+	return s.pubsub.Subscribe(ctx, channel)
+}
+
+func (s *pubsubSource) unsubscribe(ctx context.Context, channel string) error {
+	return s.pubsub.Unsubscribe(ctx, channel)
+}
+
+// run delivers messages until the PubSub is closed.
+func (s *pubsubSource) run(deliver func(channel string, ev *event)) {
+	for msg := range s.pubsub.Channel() {
+		deliver(msg.Channel, newEvent([]byte(msg.Payload)))
+	}
+}
+
+func (s *pubsubSource) close() error {
+	return s.pubsub.Close()
+}
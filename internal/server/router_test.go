@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// fakeSource records the channels a router follows.
+type fakeSource struct {
+	calls []string
+}
+
+func (s *fakeSource) subscribe(ctx context.Context, channel string) error {
+	s.calls = append(s.calls, "+"+channel)
+	return nil
+}
+
+func (s *fakeSource) unsubscribe(ctx context.Context, channel string) error {
+	s.calls = append(s.calls, "-"+channel)
+	return nil
+}
+
+func (s *fakeSource) close() error { return nil }
+
+func TestSubscriptionRouter(t *testing.T) {
+	a, b := &Connection{ID: "a"}, &Connection{ID: "b"}
+	type op struct {
+		c       *Connection
+		sub     bool
+		all     bool // UnsubscribeAll
+		channel string
+	}
+	tests := []struct {
+		name  string
+		ops   []op
+		calls []string // made on the source
+		a, b  []string // channels afterwards
+	}{
+		{"first subscriber subscribes", []op{{a, true, false, "x"}, {b, true, false, "x"}},
+			[]string{"+x"}, []string{"x"}, []string{"x"}},
+		{"last subscriber unsubscribes", []op{{a, true, false, "x"}, {b, true, false, "x"}, {a, false, false, "x"}, {b, false, false, "x"}},
+			[]string{"+x", "-x"}, nil, nil},
+		{"subscribing twice counts once", []op{{a, true, false, "x"}, {a, true, false, "x"}, {a, false, false, "x"}},
+			[]string{"+x", "-x"}, nil, nil},
+		{"unknown channel", []op{{a, false, false, "x"}},
+			nil, nil, nil},
+		{"unsubscribe all", []op{{a, true, false, "x"}, {a, true, false, "y"}, {b, true, false, "y"}, {a, false, true, ""}},
+			[]string{"+x", "+y", "-x"}, nil, []string{"y"}},
+	}
+	for _, tt := range tests {
+		src := &fakeSource{}
+		r := newRouter()
+		r.source = src
+		ctx := context.Background()
+		for _, op := range tt.ops {
+			var err error
+			switch {
+			case op.all:
+				r.UnsubscribeAll(ctx, op.c)
+			case op.sub:
+				err = r.Subscribe(ctx, op.c, op.channel)
+			default:
+				err = r.Unsubscribe(ctx, op.c, op.channel)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+
+		if !reflect.DeepEqual(src.calls, tt.calls) {
+			t.Errorf("%s: source calls = %v, want %v", tt.name, src.calls, tt.calls)
+		}
+		for c, want := range map[*Connection][]string{a: tt.a, b: tt.b} {
+			got := r.Channels(c)
+			slices.Sort(got)
+			if !slices.Equal(got, want) {
+				t.Errorf("%s: channels of %s = %v, want %v", tt.name, c.ID, got, want)
+			}
+		}
+		if len(tt.a) == 0 && len(tt.b) == 0 && (len(r.subs) > 0 || len(r.conns) > 0) {
+			t.Errorf("%s: router kept %v and %v", tt.name, r.subs, r.conns)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"go-server/internal/db"
+	"go-server/internal/server/errcode"
+
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Every connection gets a resume token in a session event when it opens.
+// When the socket drops, the session's channels and joined lobbies are
+// kept for Config.ResumeTTL. A new connection of the same user can send
+// resume with the token and the last event seq it saw to get its
+// subscriptions back and the missed events replayed from the channels'
+// backlogs (see db.EventBacklog) before live events continue. Leaving the
+// lobbies is deferred until the session expires unclaimed.
+func init() {
+	Actions.Register("resume", handleResume, RequireArgs(1, "resume token required"))
+}
+
+// sessionRecord is what a suspended session leaves in Redis.
+type sessionRecord struct {
+	UserID   int      `json:"user_id"`
+	Username string   `json:"username"`
+	Channels []string `json:"channels,omitempty"`
+	Lobbies  []string `json:"lobbies,omitempty"`
+	Expires  int64    `json:"expires"` // unix milliseconds
+}
+
+func sessionKey(token string) string {
+	return "session:" + token
+}
+
+// sessionExpiryKey is a sorted set of suspended session tokens, scored by
+// when they expire.
+const sessionExpiryKey = "sessions:expiry"
+
+const (
+	// sessionSweepInterval is how often a node looks for expired
+	// sessions, so how long their lobby seats may outlive them.
+	sessionSweepInterval = 5 * time.Second
+	sessionSweepBatch    = 100
+)
+
+// SessionStore keeps suspended sessions in Redis. Every node sweeps the
+// sessions that expire unclaimed and leaves their lobbies, so seats are
+// released even if the node that suspended a session is gone.
+type SessionStore struct {
+	rm  *db.RedisManager
+	ttl time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewSessionStore(ctx context.Context, rm *db.RedisManager, ttl time.Duration) *SessionStore {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &SessionStore{
+		rm:     rm,
+		ttl:    ttl,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go s.run(ctx)
+	return s
+}
+
+// Suspend stores rec under token until it is claimed or swept.
+func (s *SessionStore) Suspend(ctx context.Context, token string, rec sessionRecord) error {
+	rec.Expires = time.Now().Add(s.ttl).UnixMilli()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	// The record has no TTL of its own: the sweep that expires it must
+	// still find its lobbies.
+	_, err = s.rm.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionKey(token), data, 0)
+		pipe.ZAdd(ctx, sessionExpiryKey, redis.Z{Score: float64(rec.Expires), Member: token})
+		return nil
+	})
+	return err
+}
+
+var errSessionExpired = errors.New("session expired")
+
+// Claim takes the session stored under token for user. A session can be
+// claimed once. Claims by other users leave it untouched.
+func (s *SessionStore) Claim(ctx context.Context, token string, userID int) (*sessionRecord, error) {
+	data, err := claimSession.Run(ctx, s.rm.Client, []string{sessionKey(token), sessionExpiryKey}, userID, token).Result()
+	rec, err := decodeSession(data, err)
+	if err != nil {
+		return nil, err
+	}
+	if rec.UserID != userID {
+		return nil, fmt.Errorf("session belongs to another user")
+	}
+	if time.Now().UnixMilli() > rec.Expires {
+		// No sweep got to it yet, and none will now.
+		s.leaveLobbies(ctx, rec)
+		return nil, errSessionExpired
+	}
+	return rec, nil
+}
+
+// claimSession deletes the session only if it belongs to the user in
+// ARGV[1], and returns it either way.
+var claimSession = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+if not data then
+    return false
+end
+if cjson.decode(data).user_id == tonumber(ARGV[1]) then
+    redis.call("DEL", KEYS[1])
+    redis.call("ZREM", KEYS[2], ARGV[2])
+end
+return data
+`)
+
+// expireSession removes the session whose token is ARGV[1] and returns
+// it, unless a claim or another node's sweep got to it first.
+var expireSession = redis.NewScript(`
+if redis.call("ZREM", KEYS[2], ARGV[1]) == 0 then
+    return false
+end
+local data = redis.call("GET", KEYS[1])
+redis.call("DEL", KEYS[1])
+return data or false
+`)
+
+func decodeSession(data interface{}, err error) (*sessionRecord, error) {
+	if errors.Is(err, redis.Nil) {
+		return nil, errSessionExpired
+	}
+	if err != nil {
+		return nil, err
+	}
+	str, _ := data.(string)
+	var rec sessionRecord
+	if err := json.Unmarshal([]byte(str), &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *SessionStore) run(ctx context.Context) {
+	defer close(s.done)
+	ticker := time.NewTicker(min(s.ttl, sessionSweepInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.sweep(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Printf("session sweep failed: %v", err)
+		}
+	}
+}
+
+// sweep leaves the lobbies of sessions that expired by now unclaimed.
+func (s *SessionStore) sweep(ctx context.Context, now time.Time) error {
+	tokens, err := s.rm.Client.ZRangeByScore(ctx, sessionExpiryKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixMilli(), 10),
+		Count: sessionSweepBatch,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		rec, err := decodeSession(expireSession.Run(ctx, s.rm.Client, []string{sessionKey(token), sessionExpiryKey}, token).Result())
+		if errors.Is(err, errSessionExpired) {
+			continue
+		}
+		if err != nil {
+			log.Printf("expire session failed: %v", err)
+			continue
+		}
+		s.leaveLobbies(ctx, rec)
+	}
+	return nil
+}
+
+func (s *SessionStore) leaveLobbies(ctx context.Context, rec *sessionRecord) {
+	for _, lobbyID := range rec.Lobbies {
+		if _, err := leaveLobbyAs(ctx, s.rm, rec.Username, lobbyID); err != nil {
+			log.Printf("leave_lobby %s for expired session of %s failed: %v", lobbyID, rec.Username, err)
+		}
+	}
+}
+
+// Close stops sweeping. Suspended sessions keep their seats, and other
+// nodes, or this one after a restart, expire them.
+func (s *SessionStore) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// startSession sends the connection its resume token.
+func (c *Connection) startSession() {
+	token, err := gonanoid.New()
+	if err != nil {
+		log.Printf("session token for %s failed: %v", c.ID, err)
+		return
+	}
+	c.mu.Lock()
+	c.session = token
+	c.mu.Unlock()
+	c.sendEvent(map[string]interface{}{
+		"type":          "session",
+		"resume_token":  token,
+		"resume_ttl_ms": c.cfg.ResumeTTL.Milliseconds(),
+	})
+}
+
+// suspend stores the connection's session when it closes. It reports
+// whether leaving the joined lobbies was deferred. Sessions without
+// channels or lobbies are not stored, as there is nothing to resume.
+func (c *Connection) suspend(ctx context.Context) bool {
+	c.mu.Lock()
+	token := c.session
+	c.mu.Unlock()
+	if c.sessions == nil || token == "" {
+		return false
+	}
+	rec := sessionRecord{
+		UserID:   c.user.ID,
+		Username: c.user.Username,
+		Channels: c.router.Channels(c),
+		Lobbies:  c.joinedLobbies(),
+	}
+	if len(rec.Channels) == 0 && len(rec.Lobbies) == 0 {
+		return false
+	}
+	if err := c.sessions.Suspend(ctx, token, rec); err != nil {
+		log.Printf("suspend session of %s failed: %v", c.user.Username, err)
+		return false
+	}
+	for _, lobbyID := range rec.Lobbies {
+		c.leftLobby(lobbyID)
+	}
+	return true
+}
+
+// handleResume restores a suspended session: Args[0] is its resume token
+// and the optional Args[1] the last seq the client saw, either one seq for
+// every channel or an object of channel -> seq. Without it no events are
+// replayed.
+func handleResume(ctx context.Context, c *Connection, packet ClientMessage) {
+	if c.sessions == nil {
+		c.sendError(packet.ID, errcode.InvalidRequest, "sessions are disabled")
+		return
+	}
+	token, _ := packet.Args[0].(string)
+	var lastSeq interface{}
+	if len(packet.Args) > 1 {
+		lastSeq = packet.Args[1]
+	}
+
+	rec, err := c.sessions.Claim(ctx, token, c.user.ID)
+	if errors.Is(err, errSessionExpired) {
+		c.sendError(packet.ID, errcode.SessionExpired, "session expired, start over")
+		return
+	}
+	if err != nil {
+		log.Printf("resume for %s failed: %v", c.user.Username, err)
+		c.sendError(packet.ID, errcode.SessionExpired, "session cannot be resumed")
+		return
+	}
+
+	// Hold live events until the missed ones are queued.
+	c.holdEvents()
+	replayed := make(map[string]string)
+	defer func() { c.releaseEvents(replayed) }()
+
+	// The player may have been kicked, or the lobby closed, meanwhile.
+	lobbies := make([]string, 0, len(rec.Lobbies))
+	for _, lobbyID := range rec.Lobbies {
+		member, err := c.rm.Client.HExists(ctx, LobbyPlayersKey(lobbyID), rec.Username).Result()
+		if err != nil {
+			log.Printf("resume lobby %s for %s failed: %v", lobbyID, rec.Username, err)
+			continue
+		}
+		if member {
+			c.joinedLobby(lobbyID)
+			lobbies = append(lobbies, lobbyID)
+		}
+	}
+
+	channels := make([]string, 0, len(rec.Channels))
+	count := 0
+	for _, channel := range rec.Channels {
+		ok, err := c.cfg.ChannelPolicy.CanSubscribe(ctx, c.rm, c.user, channel)
+		if err != nil || !ok {
+			continue
+		}
+		if err := c.router.Subscribe(ctx, c, channel); err != nil {
+			log.Printf("resume subscribe %s failed: %v", channel, err)
+			continue
+		}
+		c.hub.subscribed(c, channel)
+		channels = append(channels, channel)
+
+		if since := seqFor(lastSeq, channel); since != "" {
+			var n int
+			replayed[channel], n = c.catchUp(ctx, channel, since)
+			count += n
+		}
+	}
+
+	c.sendResponse(packet.ID, map[string]interface{}{
+		"channels": channels,
+		"lobbies":  lobbies,
+		"replayed": count,
+	})
+}
+
+// seqFor returns the seq the client saw last on channel.
+func seqFor(lastSeq interface{}, channel string) string {
+	switch v := lastSeq.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		s, _ := v[channel].(string)
+		return s
+	}
+	return ""
+}
+
+// withSeq adds "seq" to an event stored in a backlog.
+func withSeq(data, seq string) ([]byte, error) {
+	var evt map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &evt); err != nil {
+		return nil, err
+	}
+	evt["seq"] = seq
+	return json.Marshal(evt)
+}
+
+// compareSeq orders two stream entry IDs ("<ms>-<n>").
+func compareSeq(a, b string) int {
+	var am, an, bm, bn uint64
+	fmt.Sscanf(a, "%d-%d", &am, &an)
+	fmt.Sscanf(b, "%d-%d", &bm, &bn)
+	if am != bm {
+		return cmp.Compare(am, bm)
+	}
+	return cmp.Compare(an, bn)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go-server/internal/auth"
+	"go-server/internal/db"
+)
+
+// seatAlice creates lobby abc with alice in it.
+func seatAlice(t *testing.T, rm *db.RedisManager) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := rm.CallScript(ctx, "create_lobby", []string{LobbyKey("abc")}, "", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := lobbyKeys("abc")
+	if _, err := rm.CallScript(ctx, "join_lobby", keys, "abc", "alice", "{}"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	rec := sessionRecord{UserID: 1, Username: "alice", Channels: []string{"news"}, Lobbies: []string{"abc"}}
+	tests := []struct {
+		name   string
+		run    func(ctx context.Context, s *SessionStore) error
+		err    error // of run, if any
+		seated bool  // alice is still in abc
+		stored bool  // the session is still in Redis
+	}{
+		{"claim", func(ctx context.Context, s *SessionStore) error {
+			got, err := s.Claim(ctx, "tok", 1)
+			if err == nil && got.Username != "alice" {
+				t.Errorf("claimed %+v", got)
+			}
+			return err
+		}, nil, true, false},
+		{"claim twice", func(ctx context.Context, s *SessionStore) error {
+			s.Claim(ctx, "tok", 1)
+			_, err := s.Claim(ctx, "tok", 1)
+			return err
+		}, errSessionExpired, true, false},
+		{"other user", func(ctx context.Context, s *SessionStore) error {
+			_, err := s.Claim(ctx, "tok", 2)
+			if err == nil {
+				return errors.New("claimed by another user")
+			}
+			return nil
+		}, nil, true, true},
+		{"sweep before expiry", func(ctx context.Context, s *SessionStore) error {
+			return s.sweep(ctx, time.Now())
+		}, nil, true, true},
+		{"sweep after expiry", func(ctx context.Context, s *SessionStore) error {
+			if err := s.sweep(ctx, time.Now().Add(time.Hour)); err != nil {
+				return err
+			}
+			// A swept session cannot be claimed.
+			_, err := s.Claim(ctx, "tok", 1)
+			return err
+		}, errSessionExpired, false, false},
+		{"close keeps seats", func(ctx context.Context, s *SessionStore) error {
+			s.Close()
+			return nil
+		}, nil, true, true},
+	}
+	for _, tt := range tests {
+		mr, rm := newTestRedis(t, db.EventBacklog{})
+		seatAlice(t, rm)
+		ctx := context.Background()
+		s := NewSessionStore(ctx, rm, time.Minute)
+		if err := s.Suspend(ctx, "tok", rec); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tt.run(ctx, s); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+		if seated := mr.HGet(LobbyPlayersKey("abc"), "alice") != ""; seated != tt.seated {
+			t.Errorf("%s: seated = %v, want %v", tt.name, seated, tt.seated)
+		}
+		stored := mr.Exists(sessionKey("tok"))
+		queued, _ := mr.ZScore(sessionExpiryKey, "tok")
+		if stored != tt.stored || (queued != 0) != tt.stored {
+			t.Errorf("%s: stored = %v, queued at %v, want %v", tt.name, stored, queued, tt.stored)
+		}
+		s.Close()
+	}
+}
+
+func TestSessionStoreClaimExpired(t *testing.T) {
+	mr, rm := newTestRedis(t, db.EventBacklog{})
+	seatAlice(t, rm)
+	ctx := context.Background()
+	s := NewSessionStore(ctx, rm, time.Millisecond)
+	// Stop sweeping so the claim finds the expired session.
+	s.Close()
+
+	if err := s.Suspend(ctx, "tok", sessionRecord{UserID: 1, Username: "alice", Lobbies: []string{"abc"}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.Claim(ctx, "tok", 1); !errors.Is(err, errSessionExpired) {
+		t.Errorf("error = %v, want errSessionExpired", err)
+	}
+	if mr.HGet(LobbyPlayersKey("abc"), "alice") != "" {
+		t.Error("alice kept her seat")
+	}
+}
+
+func TestResumeSkipsLeftLobbies(t *testing.T) {
+	_, rm := newTestRedis(t, db.EventBacklog{})
+	seatAlice(t, rm)
+	s := NewServer(context.Background(), rm, nil, Config{})
+	t.Cleanup(func() { s.Close() })
+	ctx := context.Background()
+	// alice is no longer in lobby gone, e.g. because it was closed.
+	if err := s.sessions.Suspend(ctx, "tok", sessionRecord{UserID: 1, Username: "alice", Lobbies: []string{"abc", "gone"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := serveTest(t, s)(auth.User{ID: 1, Username: "alice", Role: auth.RoleUser})
+	alice.send(`{"Id":"r","Action":"resume","Args":["tok"]}`)
+	resp := alice.response("r")
+	result, _ := resp["result"].(map[string]interface{})
+	lobbies, _ := result["lobbies"].([]interface{})
+	if len(lobbies) != 1 || lobbies[0] != "abc" {
+		t.Errorf("resumed lobbies = %v, want [abc]", result["lobbies"])
+	}
+}
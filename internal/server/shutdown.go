@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// QueueStats sums the outbound queue stats of every live connection.
+func (s *Server) QueueStats() QueueStats {
+	var total QueueStats
+	for _, c := range s.hub.Connections() {
+		st := c.QueueStats()
+		total.Depth += st.Depth
+		total.Dropped += st.Dropped
+		total.Coalesced += st.Coalesced
+	}
+	return total
+}
+
+// track registers c as live. It returns false once Shutdown has started;
+// otherwise the caller must call s.active.Done once c is closed.
+func (s *Server) track(c *Connection) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return false
+	}
+	s.active.Add(1)
+	s.hub.Register(c)
+	return true
+}
+
+func (s *Server) untrack(c *Connection) {
+	s.hub.Unregister(c)
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+// Shutdown stops accepting new WebSocket connections, tells every connected
+// client to reconnect after reconnectAfter with a server_shutdown event, and
+// closes their sockets with StatusServiceRestart. It returns once every
+// connection has finished closing, so their lobbies are left and sessions
+// suspended while Redis is still up, or once ctx is done. Redis data is
+// left untouched.
+func (s *Server) Shutdown(ctx context.Context, reconnectAfter time.Duration) error {
+	s.mu.Lock()
+	s.shutdown = true
+	s.mu.Unlock()
+	conns := s.hub.Connections()
+
+	log.Printf("Draining %d WebSocket connections...", len(conns))
+
+	notice := map[string]interface{}{
+		"type":               "server_shutdown",
+		"reconnect_after_ms": reconnectAfter.Milliseconds(),
+	}
+
+	for _, c := range conns {
+		go func(c *Connection) {
+			// Write directly: the event must go out ahead of anything
+			// still queued for the connection.
+			event, _ := c.codec.Marshal(notice)
+			if err := c.conn.Write(ctx, c.codec.MessageType(), event); err != nil {
+				log.Printf("shutdown notice to %s failed: %v", c.user.Username, err)
+			}
+			c.conn.Close(websocket.StatusServiceRestart, "server shutting down")
+		}(c)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Drain timed out:", ctx.Err())
+	}
+	return s.Close()
+}
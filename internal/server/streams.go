@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	"go-server/internal/db"
+)
+
+const (
+	streamReadBlock = 250 * time.Millisecond // upper bound on picking up a new channel
+	streamReadCount = 100                    // events per channel and read
+	streamRetry     = time.Second            // pause after a failed read
+)
+
+// NewStreamRouter returns a router fed by the channels' event streams
+// instead of Pub/Sub; see db.EventBacklog.Streams. Each event is delivered
+// with its stream entry ID as "seq".
+func NewStreamRouter(ctx context.Context, rm *db.RedisManager) *SubscriptionRouter {
+	r := newRouter()
+	ctx, cancel := context.WithCancel(ctx)
+	s := &streamSource{
+		rm:      rm,
+		cursors: make(map[string]string),
+		wake:    make(chan struct{}, 1),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go s.run(ctx, r.dispatch)
+	r.source = s
+	return r
+}
+
+// streamSource follows every subscribed channel with a single XREAD loop.
+// A channel's cursor starts at its newest event when the first connection
+// on this node subscribes and only moves forward, so events published
+// between two reads are not lost.
+type streamSource struct {
+	rm *db.RedisManager
+
+	mu      sync.Mutex
+	cursors map[string]string // channel -> seq of the last event read
+
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// lastSeq returns the cursor a new subscription of channel starts at.
+func (s *streamSource) lastSeq(ctx context.Context, channel string) (string, error) {
+	return s.rm.LastEventID(ctx, channel)
+}
+
+func (s *streamSource) subscribe(ctx context.Context, channel string) error {
+	seq, err := s.lastSeq(ctx, channel)
+	if err != nil {
+		return err
+	}
+	s.follow(channel, seq)
+	return nil
+}
+
+// follow starts reading channel after seq.
+func (s *streamSource) follow(channel, seq string) {
+	s.mu.Lock()
+	s.cursors[channel] = seq
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *streamSource) unsubscribe(ctx context.Context, channel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cursors, channel)
+	return nil
+}
+
+func (s *streamSource) close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+func (s *streamSource) run(ctx context.Context, deliver func(channel string, ev *event)) {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		since := maps.Clone(s.cursors)
+		s.mu.Unlock()
+		if len(since) == 0 {
+			select {
+			case <-s.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		events, err := s.rm.ReadEvents(ctx, since, streamReadCount, streamReadBlock)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("read event streams failed: %v", err)
+			select {
+			case <-time.After(streamRetry):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		for channel, batch := range events {
+			for _, e := range batch {
+				if s.advance(channel, e.Seq) {
+					deliver(channel, newEvent(eventData(e)))
+				}
+			}
+		}
+	}
+}
+
+// advance moves the cursor of channel to seq. It reports false if the
+// channel was unsubscribed meanwhile or seq is not newer.
+func (s *streamSource) advance(channel, seq string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.cursors[channel]
+	if !ok || compareSeq(seq, cur) <= 0 {
+		return false
+	}
+	s.cursors[channel] = seq
+	return true
+}
+
+// eventData returns a stored event with its seq, or as stored if it is not
+// a JSON object.
+func eventData(e db.BacklogEvent) []byte {
+	data, err := withSeq(e.Data, e.Seq)
+	if err != nil {
+		return []byte(e.Data)
+	}
+	return data
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"go-server/internal/auth"
+	"go-server/internal/db"
+)
+
+func TestEventTransports(t *testing.T) {
+	tests := []struct {
+		name    string
+		backlog db.EventBacklog
+	}{
+		{"pubsub", db.EventBacklog{}},
+		{"pubsub with backlog", db.EventBacklog{Size: 10}},
+		{"streams", db.EventBacklog{Streams: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rm := newTestRedis(t, tt.backlog)
+			s := NewServer(context.Background(), rm, nil, Config{ChannelPolicy: &ChannelPolicy{Default: AllowAny}})
+			t.Cleanup(func() { s.Close() })
+			connect := serveTest(t, s)
+			alice := connect(auth.User{ID: 1, Username: "alice", Role: auth.RoleUser})
+			bob := connect(auth.User{ID: 2, Username: "bob", Role: auth.RoleUser})
+			ctx := context.Background()
+
+			alice.send(`{"Id":"1","Action":"subscribe","Args":["news"]}`)
+			alice.response("1")
+			bob.send(`{"Id":"1","Action":"subscribe","Args":["news"]}`)
+			bob.response("1")
+
+			if err := rm.PublishEvent(ctx, "news", []byte(`{"type":"first"}`)); err != nil {
+				t.Fatal(err)
+			}
+			first := alice.event("first")
+			bob.event("first")
+			seq, _ := first["seq"].(string)
+			if (seq != "") != rm.HasBacklog() {
+				t.Errorf("first = %v, want a seq only with a backlog", first)
+			}
+
+			// Bob stops listening; alice still gets events.
+			bob.send(`{"Id":"2","Action":"unsubscribe","Args":["news"]}`)
+			bob.response("2")
+			if err := rm.PublishEvent(ctx, "news", []byte(`{"type":"second"}`)); err != nil {
+				t.Fatal(err)
+			}
+			alice.event("second")
+			bob.send(`{"Id":"3","Action":"ping"}`)
+			bob.response("3")
+
+			if !rm.HasBacklog() {
+				return
+			}
+			// Subscribing again since the first event replays the second.
+			bob.send(`{"Id":"4","Action":"subscribe","Args":["news","` + seq + `"]}`)
+			resp := bob.response("4")
+			if result, _ := resp["result"].(map[string]interface{}); result["replayed"] != float64(1) {
+				t.Errorf("resubscribe = %v, want 1 event replayed", resp)
+			}
+			bob.event("second")
+			if err := rm.PublishEvent(ctx, "news", []byte(`{"type":"third"}`)); err != nil {
+				t.Fatal(err)
+			}
+			bob.event("third")
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go-server/internal/db"
+
+	gonanoid "github.com/matoous/go-nanoid/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// tickLockTTL is how long a node owns a lobby's tick without renewing it,
+// and so how long a lobby stalls when its node dies.
+const tickLockTTL = 3 * time.Second
+
+// TickInput is a player input queued with the send_input script.
+type TickInput struct {
+	Player string          `json:"player"`
+	Input  json.RawMessage `json:"input"`
+}
+
+// Tick is one step of a lobby's simulation. Its inputs stay queued until
+// the tick is committed, after the handler succeeded.
+type Tick struct {
+	LobbyID string
+	Number  int64       // counts up per lobby, across nodes
+	Inputs  []TickInput // queued since the last tick, oldest first
+	Redis   *db.RedisManager
+
+	// Owner is the token of the tick lock. Scripts can pass it to
+	// commit_tick to change nothing once another node took over.
+	Owner string
+	taken int // queued inputs, including malformed ones
+}
+
+// TickHandler advances a lobby by one tick. It returns the snapshot to
+// publish to the lobby as a "tick" event, or nil to publish nothing.
+type TickHandler interface {
+	Tick(ctx context.Context, t *Tick) (interface{}, error)
+}
+
+// TickFunc adapts a function to a TickHandler.
+type TickFunc func(ctx context.Context, t *Tick) (interface{}, error)
+
+func (f TickFunc) Tick(ctx context.Context, t *Tick) (interface{}, error) {
+	return f(ctx, t)
+}
+
+// LuaTickHandler runs script once per tick with KEYS = the lobby scripts'
+// KEYS, the inputs list and the tick lock, and ARGV = lobbyId, tick number,
+// inputs as a JSON array, lock token, number of inputs taken. The script's
+// "snapshot" field is published; see lua_scripts/lobby_tick.lua.
+func LuaTickHandler(script string) TickHandler {
+	return TickFunc(func(ctx context.Context, t *Tick) (interface{}, error) {
+		inputs, err := json.Marshal(t.Inputs)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := lobbyKeys(t.LobbyID)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, LobbyInputsKey(t.LobbyID), tickLockKey(t.LobbyID))
+		res, err := t.Redis.CallScript(ctx, script, keys, t.LobbyID, t.Number, inputs, t.Owner, t.taken)
+		if err != nil {
+			return nil, err
+		}
+		return res["snapshot"], nil
+	})
+}
+
+// TickScheduler ticks the lobbies that have players on this node, each in
+// its own loop at Config.TickRate. A Redis lock makes sure only one node
+// ticks a lobby; the others keep trying to take over in case it goes away.
+type TickScheduler struct {
+	rm       *db.RedisManager
+	handler  TickHandler
+	interval time.Duration
+	node     string // lock owner ID of this node
+
+	mu    sync.Mutex
+	loops map[string]*tickLoop // lobby -> loop
+}
+
+type tickLoop struct {
+	players int // on this node
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func NewTickScheduler(rm *db.RedisManager, handler TickHandler, rate int) *TickScheduler {
+	return &TickScheduler{
+		rm:       rm,
+		handler:  handler,
+		interval: time.Second / time.Duration(rate),
+		node:     gonanoid.Must(),
+		loops:    make(map[string]*tickLoop),
+	}
+}
+
+// join notes a player on this node in lobbyID, starting its loop for the
+// first one.
+func (s *TickScheduler) join(lobbyID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	loop, ok := s.loops[lobbyID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		loop = &tickLoop{cancel: cancel, done: make(chan struct{})}
+		s.loops[lobbyID] = loop
+		go s.run(ctx, lobbyID, loop.done)
+	}
+	loop.players++
+}
+
+// leave undoes join, stopping the loop after the last player.
+func (s *TickScheduler) leave(lobbyID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	loop, ok := s.loops[lobbyID]
+	if !ok {
+		return
+	}
+	if loop.players--; loop.players == 0 {
+		delete(s.loops, lobbyID)
+		loop.cancel()
+	}
+}
+
+// Close stops every loop and hands their locks back, so other nodes can
+// take over right away.
+func (s *TickScheduler) Close() {
+	s.mu.Lock()
+	loops := s.loops
+	s.loops = make(map[string]*tickLoop)
+	s.mu.Unlock()
+	for _, loop := range loops {
+		loop.cancel()
+		<-loop.done
+	}
+}
+
+func tickLockKey(lobbyID string) string {
+	return LobbyKey(lobbyID) + ":tick_owner"
+}
+
+// claimTick takes the lock or, if this node holds it already, renews it.
+var claimTick = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+    return 1
+end
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    redis.call("PEXPIRE", KEYS[1], ARGV[2])
+    return 1
+end
+return 0
+`)
+
+// releaseTick deletes the lock if this node holds it.
+var releaseTick = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func (s *TickScheduler) run(ctx context.Context, lobbyID string, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	key := tickLockKey(lobbyID)
+	var owned bool
+	var claimed time.Time
+	defer func() {
+		if !owned {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		if err := releaseTick.Run(ctx, s.rm.Client, []string{key}, s.node).Err(); err != nil {
+			log.Printf("release tick of lobby %s failed: %v", lobbyID, err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Since(claimed) >= tickLockTTL/3 {
+			n, err := claimTick.Run(ctx, s.rm.Client, []string{key}, s.node, tickLockTTL.Milliseconds()).Int()
+			if err != nil && ctx.Err() == nil {
+				log.Printf("claim tick of lobby %s failed: %v", lobbyID, err)
+			}
+			owned = err == nil && n == 1
+			claimed = time.Now()
+		}
+		if owned {
+			s.tick(ctx, lobbyID)
+		}
+	}
+}
+
+// tick runs one tick of lobbyID and publishes its snapshot. A tick whose
+// handler fails is retried with the same inputs.
+func (s *TickScheduler) tick(ctx context.Context, lobbyID string) {
+	keys := []string{LobbyKey(lobbyID), LobbyInputsKey(lobbyID), tickLockKey(lobbyID)}
+	res, err := s.rm.CallScript(ctx, "tick_inputs", keys, s.node)
+	if err != nil {
+		s.tickFailed(ctx, lobbyID, err)
+		return
+	}
+
+	number, _ := res["tick"].(float64)
+	// An empty list comes back from Lua as {}.
+	entries, _ := res["inputs"].([]interface{})
+	t := &Tick{
+		LobbyID: lobbyID,
+		Number:  int64(number),
+		Inputs:  make([]TickInput, 0, len(entries)),
+		Redis:   s.rm,
+		Owner:   s.node,
+		taken:   len(entries),
+	}
+	for _, entry := range entries {
+		var input TickInput
+		if raw, ok := entry.(string); ok && json.Unmarshal([]byte(raw), &input) == nil {
+			t.Inputs = append(t.Inputs, input)
+		}
+	}
+
+	snapshot, err := s.handler.Tick(ctx, t)
+	if err == nil {
+		_, err = s.rm.CallScript(ctx, "tick_done", keys, s.node, t.Number, t.taken)
+	}
+	if err != nil {
+		s.tickFailed(ctx, lobbyID, err)
+		return
+	}
+	if snapshot == nil {
+		return
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"type":     "tick",
+		"lobby_id": lobbyID,
+		"tick":     t.Number,
+		"snapshot": snapshot,
+	})
+	if err != nil {
+		log.Printf("encode tick of lobby %s: %v", lobbyID, err)
+		return
+	}
+	if err := s.rm.PublishEvent(ctx, LobbyEventsChannel(lobbyID), data); err != nil {
+		log.Printf("publish tick of lobby %s failed: %v", lobbyID, err)
+	}
+}
+
+// tickFailed logs the failure of a tick, unless the lobby was closed or
+// another node took it over.
+func (s *TickScheduler) tickFailed(ctx context.Context, lobbyID string, err error) {
+	var scriptErr *db.ScriptError
+	if errors.As(err, &scriptErr) && (scriptErr.Code == "lobby_not_found" || scriptErr.Code == "not_tick_owner") {
+		// Closed, and the loop stops once its players leave, or the
+		// lock was lost, and the loop claims it again.
+		return
+	}
+	if ctx.Err() == nil {
+		log.Printf("tick of lobby %s failed: %v", lobbyID, err)
+	}
+}
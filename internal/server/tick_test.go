@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"go-server/internal/db"
+)
+
+// tickLobby creates lobby abc with bob in it and two of his inputs queued.
+func tickLobby(t *testing.T) (*db.RedisManager, func(field string) string) {
+	t.Helper()
+	mr, rm := newTestRedis(t, db.EventBacklog{Size: 10})
+	ctx := context.Background()
+	if _, err := rm.CallScript(ctx, "create_lobby", []string{LobbyKey("abc")}, "", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := lobbyKeys("abc")
+	if _, err := rm.CallScript(ctx, "join_lobby", keys, "abc", "bob", `{"x":0,"y":0}`); err != nil {
+		t.Fatal(err)
+	}
+	inputKeys := []string{LobbyKey("abc"), LobbyPlayersKey("abc"), LobbyInputsKey("abc")}
+	for _, input := range []string{`{"x":5}`, `{"y":6}`} {
+		if _, err := rm.CallScript(ctx, "send_input", inputKeys, "abc", "bob", input); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := func(field string) string {
+		switch field {
+		case "inputs":
+			n, _ := rm.Client.LLen(ctx, LobbyInputsKey("abc")).Result()
+			return strconv.FormatInt(n, 10)
+		case "tick":
+			return mr.HGet(LobbyKey("abc"), "tick")
+		}
+		return mr.HGet(LobbyPlayersKey("abc"), "bob")
+	}
+	return rm, state
+}
+
+func TestTick(t *testing.T) {
+	failing := TickFunc(func(ctx context.Context, t *Tick) (interface{}, error) {
+		return nil, errors.New("handler failed")
+	})
+	tests := []struct {
+		name    string
+		handler TickHandler
+		owned   bool // the scheduler holds the lock
+		state   string
+		inputs  string // left queued
+		tick    string
+		events  int
+	}{
+		{"lua handler", LuaTickHandler("lobby_tick"), true, `{"x":5,"y":6}`, "0", "1", 1},
+		{"failing handler", failing, true, `{"x":0,"y":0}`, "2", "", 0},
+		{"lock held elsewhere", LuaTickHandler("lobby_tick"), false, `{"x":0,"y":0}`, "2", "", 0},
+	}
+	for _, tt := range tests {
+		rm, state := tickLobby(t)
+		ctx := context.Background()
+		s := NewTickScheduler(rm, tt.handler, 20)
+		owner := "other"
+		if tt.owned {
+			owner = s.node
+		}
+		rm.Client.Set(ctx, tickLockKey("abc"), owner, time.Minute)
+
+		s.tick(ctx, "abc")
+		assertJSONEqual(t, tt.name, []byte(state("players")), tt.state)
+		if got := state("inputs"); got != tt.inputs {
+			t.Errorf("%s: %s inputs left, want %s", tt.name, got, tt.inputs)
+		}
+		if got := state("tick"); got != tt.tick {
+			t.Errorf("%s: tick = %q, want %q", tt.name, got, tt.tick)
+		}
+		events, _ := rm.EventsSince(ctx, LobbyEventsChannel("abc"), "0", 10)
+		ticks := 0
+		for _, e := range events {
+			var evt map[string]interface{}
+			if json.Unmarshal([]byte(e.Data), &evt) == nil && evt["type"] == "tick" {
+				ticks++
+			}
+		}
+		if ticks != tt.events {
+			t.Errorf("%s: %d tick events, want %d", tt.name, ticks, tt.events)
+		}
+	}
+}
+
+func TestTickRetriesInputs(t *testing.T) {
+	rm, state := tickLobby(t)
+	ctx := context.Background()
+	var got []*Tick
+	fail := true
+	s := NewTickScheduler(rm, TickFunc(func(ctx context.Context, t *Tick) (interface{}, error) {
+		got = append(got, t)
+		if fail {
+			return nil, errors.New("handler failed")
+		}
+		return nil, nil
+	}), 20)
+	rm.Client.Set(ctx, tickLockKey("abc"), s.node, time.Minute)
+
+	s.tick(ctx, "abc")
+	fail = false
+	s.tick(ctx, "abc")
+	if len(got) != 2 || got[1].Number != 1 || len(got[1].Inputs) != 2 {
+		t.Fatalf("ticks = %+v, want tick 1 with both inputs twice", got)
+	}
+	if state("inputs") != "0" || state("tick") != "1" {
+		t.Errorf("inputs = %s, tick = %s after the retry, want 0 and 1", state("inputs"), state("tick"))
+	}
+}
+
+func TestLobbyTickFencing(t *testing.T) {
+	rm, state := tickLobby(t)
+	ctx := context.Background()
+	rm.Client.Set(ctx, tickLockKey("abc"), "node", time.Minute)
+	keys, _ := lobbyKeys("abc")
+	keys = append(keys, LobbyInputsKey("abc"), tickLockKey("abc"))
+	inputs := `[{"player":"bob","input":{"x":1}}]`
+
+	tests := []struct {
+		name  string
+		token string
+		tick  int
+		code  string
+		state string
+	}{
+		{"stale node", "old", 1, "not_tick_owner", `{"x":0,"y":0}`},
+		{"owner", "node", 1, "", `{"x":1,"y":0}`},
+		{"same tick again", "node", 1, "", `{"x":1,"y":0}`},
+	}
+	for _, tt := range tests {
+		_, err := rm.CallScript(ctx, "lobby_tick", keys, "abc", tt.tick, inputs, tt.token, 1)
+		var scriptErr *db.ScriptError
+		if (tt.code == "") != (err == nil) || (err != nil && (!errors.As(err, &scriptErr) || scriptErr.Code != tt.code)) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.code)
+		}
+		assertJSONEqual(t, tt.name, []byte(state("players")), tt.state)
+	}
+	// Only the committed tick took its input.
+	if state("inputs") != "1" {
+		t.Errorf("%s inputs left, want 1", state("inputs"))
+	}
+}
+
+func TestTickSchedulerLoops(t *testing.T) {
+	rm, _ := tickLobby(t)
+	ctx := context.Background()
+	ticked := make(chan int64, 100)
+	s := NewTickScheduler(rm, TickFunc(func(ctx context.Context, t *Tick) (interface{}, error) {
+		ticked <- t.Number
+		return nil, nil
+	}), 100)
+
+	// Two players on this node share one loop.
+	s.join("abc")
+	s.join("abc")
+	for want := int64(1); want <= 3; want++ {
+		select {
+		case n := <-ticked:
+			if n != want {
+				t.Fatalf("tick %d, want %d", n, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("lobby did not tick")
+		}
+	}
+	if owner := rm.Client.Get(ctx, tickLockKey("abc")).Val(); owner != s.node {
+		t.Errorf("lock owner = %q, want this node", owner)
+	}
+
+	s.leave("abc")
+	s.mu.Lock()
+	running := len(s.loops)
+	s.mu.Unlock()
+	if running != 1 {
+		t.Fatalf("%d loops after one player left, want 1", running)
+	}
+	s.leave("abc")
+	// The stopped loop hands the lock back.
+	for deadline := time.Now().Add(2 * time.Second); rm.Client.Exists(ctx, tickLockKey("abc")).Val() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("lock kept after the last player left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,7 +2,8 @@ local hash   = tostring(KEYS[1])
 local action = tostring(ARGV[1])
 local field  = tostring(ARGV[2])
 
-redis.call("PUBLISH", "room1", cjson.encode({action=action, field=field, hash=hash}))
+-- Events for a key go to "<key>:events" (see create_lobby.lua)
+redis.call("PUBLISH", hash .. ":events", cjson.encode({action=action, field=field, hash=hash}))
 
 if action == "add" then
     local value = tostring(ARGV[3] or "")
@@ -15,6 +16,6 @@ elseif action == "remove" then
     return cjson.encode({status="ok", action="remove", field=field})
 
 else
-    return cjson.encode({status="error", message="invalid action: "..action})
+    return cjson.encode({status="error", code="invalid_args", message="invalid action: "..action})
 end
 
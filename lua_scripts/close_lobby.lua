@@ -0,0 +1,34 @@
+-- KEYS:
+--   KEYS[1] = "lobby:<lobbyId>"
+--   KEYS[2] = "lobby:<lobbyId>:players"
+--   KEYS[3] = "lobby:<lobbyId>:versions"
+
+-- ARGV:
+--   ARGV[1] = lobbyId
+--   ARGV[2] = hostPlayerId (caller)
+
+-- Step 1: Check lobby exists
+if redis.call("EXISTS", KEYS[1]) == 0 then
+    return cjson.encode({status="error", code="lobby_not_found", err="Lobby does not exist"})
+end
+
+-- Step 2: Check caller is the host
+if redis.call("HGET", KEYS[1], "host") ~= ARGV[2] then
+    return cjson.encode({status="error", code="not_lobby_host", err="Only the host can close the lobby"})
+end
+
+-- Step 3: Delete lobby and publish
+-- See create_lobby.lua for the channel naming scheme
+local events_channel = redis.call("HGET", KEYS[1], "events_channel") or (KEYS[1] .. ":events")
+redis.call("DEL", KEYS[1], KEYS[2], KEYS[3])
+redis.call("PUBLISH", events_channel, cjson.encode({
+    type = "lobby_closed",
+    lobby_id = ARGV[1],
+    by = ARGV[2]
+}))
+
+-- Step 4: Return success
+return cjson.encode({
+    status = "ok",
+    lobby_id = ARGV[1]
+})
@@ -3,9 +3,17 @@
 
 -- ARGV:
 --   ARGV[1] = maxPlayers (optional)
+--   ARGV[2] = hostPlayerId (the creating player)
+
+-- Channel naming scheme:
+--   Every event about a lobby is published on "<lobby key>:events", i.e.
+--   "lobby:<lobbyId>:events". The channel is stored in the lobby hash as
+--   "events_channel" and every lobby script publishes there, falling back to
+--   the same name for lobbies created before the field existed. The Go side
+--   derives it with server.LobbyEventsChannel.
 
 if redis.call("EXISTS", KEYS[1]) == 1 then
-    return cjson.encode({status="error", err="Lobby already exists"})
+    return cjson.encode({status="error", code="lobby_exists", err="Lobby already exists"})
 end
 
 -- Parse maxPlayers (default 10)
@@ -15,17 +23,23 @@ if maxPlayers == nil or maxPlayers < 1 then
 end
 
 local created_at = tostring(redis.call("TIME")[1])
+local events_channel = KEYS[1] .. ":events"
 
 -- Create the lobby hash
 redis.call("HMSET", KEYS[1],
     "id", KEYS[1]:sub(7),  -- Extract lobbyId from key
     "max_players", maxPlayers,
-    "created_at", created_at
+    "created_at", created_at,
+    "host", ARGV[2],
+    "locked", 0,
+    "events_channel", events_channel
 )
 
 return cjson.encode({
     status = "ok",
     id = KEYS[1],
     max_players = maxPlayers,
-    created_at = created_at
+    created_at = created_at,
+    host = ARGV[2],
+    events_channel = events_channel
 })
@@ -0,0 +1,61 @@
+-- manifest:
+-- {
+--   "access": "client",
+--   "args": [
+--     {"name": "lobby_id", "type": "string"},
+--     {"name": "player", "type": "string", "optional": true}
+--   ],
+--   "keys": ["lobby:{lobby_id}", "lobby:{lobby_id}:players", "lobby:{lobby_id}:versions"],
+--   "argv": ["{lobby_id}", "{player_id}", "{player}"]
+-- }
+
+-- KEYS:
+--   KEYS[1] = "lobby:<lobbyId>"
+--   KEYS[2] = "lobby:<lobbyId>:players"
+--   KEYS[3] = "lobby:<lobbyId>:versions"
+
+-- ARGV:
+--   ARGV[1] = lobbyId
+--   ARGV[2] = playerId (caller)
+--   ARGV[3] = playerId to read (optional; all players if empty)
+
+-- Returns the full state and version of one or every player, e.g. to
+-- resync after applying the partial updates of update_state.
+
+-- Step 1: Check lobby exists
+if redis.call("EXISTS", KEYS[1]) == 0 then
+    return cjson.encode({status="error", code="lobby_not_found", err="Lobby does not exist"})
+end
+
+-- Step 2: Check caller is in the lobby
+if redis.call("HEXISTS", KEYS[2], ARGV[2]) == 0 then
+    return cjson.encode({status="error", code="not_in_lobby", err="Player not in lobby"})
+end
+
+-- Step 3: Read the states
+local players = {}
+local versions = {}
+if ARGV[3] ~= "" then
+    local state = redis.call("HGET", KEYS[2], ARGV[3])
+    if not state then
+        return cjson.encode({status="error", code="not_in_lobby", err="Player not in lobby"})
+    end
+    players[ARGV[3]] = state
+else
+    local flat = redis.call("HGETALL", KEYS[2])
+    for i = 1, #flat, 2 do
+        players[flat[i]] = flat[i + 1]
+    end
+end
+-- Players who joined before versioning are at version 0
+for player in pairs(players) do
+    versions[player] = tonumber(redis.call("HGET", KEYS[3], player)) or 0
+end
+
+-- Step 4: Return the states
+return cjson.encode({
+    status = "ok",
+    lobby_id = ARGV[1],
+    players = players,
+    versions = versions
+})
@@ -1,6 +1,7 @@
 -- KEYS:
 --   KEYS[1] = "lobby:<lobbyId>"
 --   KEYS[2] = "lobby:<lobbyId>:players"
+--   KEYS[3] = "lobby:<lobbyId>:versions"
 
 -- ARGV:
 --   ARGV[1] = lobbyId
@@ -9,38 +10,63 @@
 
 -- Step 1: Check lobby exists
 if redis.call("EXISTS", KEYS[1]) == 0 then
-    return cjson.encode({status="error", err="Lobby does not exist"})
+    return cjson.encode({status="error", code="lobby_not_found", err="Lobby does not exist"})
 end
 
 -- Step 2: Check if already joined
 if redis.call("HEXISTS", KEYS[2], ARGV[2]) == 1 then
-    return cjson.encode({status="error", err="Already in lobby"})
+    return cjson.encode({status="error", code="already_in_lobby", err="Already in lobby"})
 end
 
--- Step 3: Check lobby full
+-- Step 3: Check lobby is not locked by its host
+if redis.call("HGET", KEYS[1], "locked") == "1" then
+    return cjson.encode({status="error", code="lobby_locked", err="Lobby is locked"})
+end
+
+-- Step 4: Check lobby full
 local maxPlayers = tonumber(redis.call("HGET", KEYS[1], "max_players"))
 local numPlayers = tonumber(redis.call("HLEN", KEYS[2]))
 if numPlayers >= maxPlayers then
-    return cjson.encode({status="error", err="Lobby full"})
+    return cjson.encode({status="error", code="lobby_full", err="Lobby full"})
 end
 
--- Step 4: Add player state
+-- Step 5: Add player state, starting at version 1
 redis.call("HSET", KEYS[2], ARGV[2], ARGV[3])
+redis.call("HSET", KEYS[3], ARGV[2], 1)
 
--- Step 5: Publish join event
-local events_channel = redis.call("HGET", KEYS[1], "events_channel")
+-- Step 6: Publish join event
+-- See create_lobby.lua for the channel naming scheme
+local events_channel = redis.call("HGET", KEYS[1], "events_channel") or (KEYS[1] .. ":events")
 local evt = cjson.encode({
     type = "player_joined",
     lobby_id = ARGV[1],
     player_id = ARGV[2],
-    state = ARGV[3]
+    state = ARGV[3],
+    version = 1
 })
 redis.call("PUBLISH", events_channel, evt)
 
--- Step 6: Return success
+-- Step 7: Take host rights over from a host who is not in the lobby
+-- The creator is host without joining; leave_lobby only migrates the host
+-- of members
+local host = redis.call("HGET", KEYS[1], "host")
+if host ~= ARGV[2] and (not host or redis.call("HEXISTS", KEYS[2], host) == 0) then
+    redis.call("HSET", KEYS[1], "host", ARGV[2])
+    redis.call("PUBLISH", events_channel, cjson.encode({
+        type = "host_changed",
+        lobby_id = ARGV[1],
+        previous_host = host or cjson.null,
+        host = ARGV[2]
+    }))
+    host = ARGV[2]
+end
+
+-- Step 8: Return success
 return cjson.encode({
     status = "ok",
     player_id = ARGV[2],
     lobby_id = ARGV[1],
-    current_players = numPlayers + 1
+    current_players = numPlayers + 1,
+    version = 1,
+    host = host
 })
@@ -0,0 +1,51 @@
+-- KEYS:
+--   KEYS[1] = "lobby:<lobbyId>"
+--   KEYS[2] = "lobby:<lobbyId>:players"
+--   KEYS[3] = "lobby:<lobbyId>:versions"
+
+-- ARGV:
+--   ARGV[1] = lobbyId
+--   ARGV[2] = hostPlayerId (caller)
+--   ARGV[3] = playerId to kick
+
+-- Step 1: Check lobby exists
+if redis.call("EXISTS", KEYS[1]) == 0 then
+    return cjson.encode({status="error", code="lobby_not_found", err="Lobby does not exist"})
+end
+
+-- Step 2: Check caller is the host
+if redis.call("HGET", KEYS[1], "host") ~= ARGV[2] then
+    return cjson.encode({status="error", code="not_lobby_host", err="Only the host can kick players"})
+end
+
+-- Step 3: Check target is another member
+if ARGV[3] == ARGV[2] then
+    return cjson.encode({status="error", code="invalid_args", err="Host cannot kick itself"})
+end
+if redis.call("HEXISTS", KEYS[2], ARGV[3]) == 0 then
+    return cjson.encode({status="error", code="not_in_lobby", err="Player not in lobby"})
+end
+
+-- Step 4: Remove player
+redis.call("HDEL", KEYS[2], ARGV[3])
+redis.call("HDEL", KEYS[3], ARGV[3])
+local numPlayers = tonumber(redis.call("HLEN", KEYS[2]))
+
+-- Step 5: Publish kick event
+-- See create_lobby.lua for the channel naming scheme
+local events_channel = redis.call("HGET", KEYS[1], "events_channel") or (KEYS[1] .. ":events")
+redis.call("PUBLISH", events_channel, cjson.encode({
+    type = "player_kicked",
+    lobby_id = ARGV[1],
+    player_id = ARGV[3],
+    by = ARGV[2],
+    current_players = numPlayers
+}))
+
+-- Step 6: Return success
+return cjson.encode({
+    status = "ok",
+    lobby_id = ARGV[1],
+    player_id = ARGV[3],
+    current_players = numPlayers
+})
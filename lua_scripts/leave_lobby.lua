@@ -0,0 +1,64 @@
+-- KEYS:
+--   KEYS[1] = "lobby:<lobbyId>"
+--   KEYS[2] = "lobby:<lobbyId>:players"
+--   KEYS[3] = "lobby:<lobbyId>:versions"
+
+-- ARGV:
+--   ARGV[1] = lobbyId
+--   ARGV[2] = playerId
+
+-- Step 1: Check lobby exists
+if redis.call("EXISTS", KEYS[1]) == 0 then
+    return cjson.encode({status="error", code="lobby_not_found", err="Lobby does not exist"})
+end
+
+-- Step 2: Check player is in the lobby
+if redis.call("HEXISTS", KEYS[2], ARGV[2]) == 0 then
+    return cjson.encode({status="error", code="not_in_lobby", err="Player not in lobby"})
+end
+
+-- Step 3: Remove player
+redis.call("HDEL", KEYS[2], ARGV[2])
+redis.call("HDEL", KEYS[3], ARGV[2])
+local numPlayers = tonumber(redis.call("HLEN", KEYS[2]))
+
+-- Step 4: Publish leave event
+-- See create_lobby.lua for the channel naming scheme
+local events_channel = redis.call("HGET", KEYS[1], "events_channel") or (KEYS[1] .. ":events")
+local evt = cjson.encode({
+    type = "player_left",
+    lobby_id = ARGV[1],
+    player_id = ARGV[2],
+    current_players = numPlayers
+})
+redis.call("PUBLISH", events_channel, evt)
+
+-- Step 5: Delete the lobby once the last player is gone
+local deleted = false
+if numPlayers == 0 then
+    redis.call("DEL", KEYS[1], KEYS[2], KEYS[3])
+    deleted = true
+end
+
+-- Step 6: Pass host rights on if the host left
+local host = redis.call("HGET", KEYS[1], "host")
+if not deleted and host == ARGV[2] then
+    host = redis.call("HKEYS", KEYS[2])[1]
+    redis.call("HSET", KEYS[1], "host", host)
+    redis.call("PUBLISH", events_channel, cjson.encode({
+        type = "host_changed",
+        lobby_id = ARGV[1],
+        previous_host = ARGV[2],
+        host = host
+    }))
+end
+
+-- Step 7: Return success
+return cjson.encode({
+    status = "ok",
+    player_id = ARGV[2],
+    lobby_id = ARGV[1],
+    current_players = numPlayers,
+    lobby_deleted = deleted,
+    host = deleted and cjson.null or host
+})
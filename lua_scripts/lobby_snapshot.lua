@@ -0,0 +1,45 @@
+-- KEYS:
+--   KEYS[1] = "lobby:<lobbyId>"
+--   KEYS[2] = "lobby:<lobbyId>:players"
+--   KEYS[3] = "lobby:<lobbyId>:versions"
+--   KEYS[4] = "lobby:<lobbyId>:events:backlog" (only with the backlog enabled)
+
+-- Returns the lobby hash, every player's state and version, and the seq of
+-- the last event they reflect. Reading them in one script keeps them
+-- consistent, so a client can render the snapshot and apply the events
+-- after seq on top.
+
+-- Step 1: Check lobby exists
+if redis.call("EXISTS", KEYS[1]) == 0 then
+    return cjson.encode({status="error", code="lobby_not_found", err="Lobby does not exist"})
+end
+
+-- Step 2: Read the lobby and its players
+local function hash(key)
+    local flat = redis.call("HGETALL", key)
+    local t = {}
+    for i = 1, #flat, 2 do
+        t[flat[i]] = flat[i + 1]
+    end
+    return t
+end
+
+local versions = {}
+for player, version in pairs(hash(KEYS[3])) do
+    versions[player] = tonumber(version)
+end
+
+local snapshot = {
+    status = "ok",
+    lobby = hash(KEYS[1]),
+    players = hash(KEYS[2]),
+    versions = versions
+}
+
+-- Step 3: Note the last event; "0-0" if there was none yet
+if KEYS[4] then
+    local last = redis.call("XREVRANGE", KEYS[4], "+", "-", "COUNT", 1)
+    snapshot.seq = last[1] and last[1][1] or "0-0"
+end
+
+return cjson.encode(snapshot)
@@ -0,0 +1,70 @@
+-- KEYS:
+--   KEYS[1] = "lobby:<lobbyId>"
+--   KEYS[2] = "lobby:<lobbyId>:players"
+--   KEYS[3] = "lobby:<lobbyId>:versions"
+--   KEYS[4] = "lobby:<lobbyId>:inputs"
+--   KEYS[5] = "lobby:<lobbyId>:tick_owner"
+
+-- ARGV:
+--   ARGV[1] = lobbyId
+--   ARGV[2] = tick number
+--   ARGV[3] = inputsJson, oldest first (e.g. [{"player":"bob","input":{"x":5}}])
+--   ARGV[4] = token of the node holding the tick lock
+--   ARGV[5] = number of queued inputs the tick took
+
+-- Default tick handler, see server.LuaTickHandler: every input is a JSON
+-- merge patch (RFC 7386) on its player's state, as with update_state. The
+-- snapshot holds the state and version of the players that changed; ticks
+-- without inputs publish nothing.
+
+-- decode, encode and merge_patch come from the prelude every script gets;
+-- see scriptLib in internal/db.
+
+-- Step 1: Commit the tick with its changes, so a node that lost the lock
+-- changes nothing and no input is applied twice
+local committed, err = commit_tick(KEYS[1], KEYS[4], KEYS[5], ARGV[4], tonumber(ARGV[2]), tonumber(ARGV[5]))
+if err then
+    return cjson.encode({status = "error", code = err, err = "Lobby is ticked by another node"})
+end
+if not committed then
+    return cjson.encode({status = "ok"})
+end
+
+-- Step 2: Apply the inputs of players still in the lobby
+local states = {}
+local inputs = decode(ARGV[3], true)
+if inputs == EMPTY_ARRAY then
+    inputs = {}
+end
+for _, entry in ipairs(inputs) do
+    local player = entry.player
+    if states[player] == nil then
+        local state = redis.call("HGET", KEYS[2], player)
+        if state then
+            local ok, decoded = pcall(decode, state)
+            states[player] = ok and decoded or {}
+        end
+    end
+    if states[player] ~= nil then
+        states[player] = merge_patch(states[player], entry.input)
+    end
+end
+
+if next(states) == nil then
+    return cjson.encode({status = "ok"})
+end
+
+-- Step 3: Store the new states, one version bump per tick
+local players = {}
+local versions = {}
+for player, state in pairs(states) do
+    players[player] = encode(state)
+    redis.call("HSET", KEYS[2], player, players[player])
+    versions[player] = redis.call("HINCRBY", KEYS[3], player, 1)
+end
+
+-- Step 4: Return the snapshot to publish
+return cjson.encode({
+    status = "ok",
+    snapshot = {players = players, versions = versions}
+})
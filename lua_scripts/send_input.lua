@@ -0,0 +1,46 @@
+-- manifest:
+-- {
+--   "access": "client",
+--   "args": [
+--     {"name": "lobby_id", "type": "string"},
+--     {"name": "input", "type": "json"}
+--   ],
+--   "keys": ["lobby:{lobby_id}", "lobby:{lobby_id}:players", "lobby:{lobby_id}:inputs"],
+--   "argv": ["{lobby_id}", "{player_id}", "{input}"]
+-- }
+
+-- KEYS:
+--   KEYS[1] = "lobby:<lobbyId>"
+--   KEYS[2] = "lobby:<lobbyId>:players"
+--   KEYS[3] = "lobby:<lobbyId>:inputs"
+
+-- ARGV:
+--   ARGV[1] = lobbyId
+--   ARGV[2] = playerId
+--   ARGV[3] = inputJson (e.g. {"move":"left"})
+
+-- Queues a player input for the lobby's next tick; see server.TickScheduler.
+-- Inputs nobody collects expire, and at most 1000 are kept.
+
+-- Step 1: Check lobby exists
+if redis.call("EXISTS", KEYS[1]) == 0 then
+    return cjson.encode({status="error", code="lobby_not_found", err="Lobby does not exist"})
+end
+
+-- Step 2: Check player is in the lobby
+if redis.call("HEXISTS", KEYS[2], ARGV[2]) == 0 then
+    return cjson.encode({status="error", code="not_in_lobby", err="Player not in lobby"})
+end
+
+-- Step 3: Queue the input as is; ARGV[3] is valid JSON
+local input = '{"player":' .. cjson.encode(ARGV[2]) .. ',"input":' .. ARGV[3] .. '}'
+local queued = redis.call("RPUSH", KEYS[3], input)
+redis.call("LTRIM", KEYS[3], -1000, -1)
+redis.call("PEXPIRE", KEYS[3], 10000)
+
+-- Step 4: Return success
+return cjson.encode({
+    status = "ok",
+    lobby_id = ARGV[1],
+    queued = math.min(queued, 1000)
+})
@@ -0,0 +1,35 @@
+-- KEYS:
+--   KEYS[1] = "lobby:<lobbyId>"
+
+-- ARGV:
+--   ARGV[1] = lobbyId
+--   ARGV[2] = hostPlayerId (caller)
+--   ARGV[3] = "1" to lock, "0" to unlock
+
+-- Step 1: Check lobby exists
+if redis.call("EXISTS", KEYS[1]) == 0 then
+    return cjson.encode({status="error", code="lobby_not_found", err="Lobby does not exist"})
+end
+
+-- Step 2: Check caller is the host
+if redis.call("HGET", KEYS[1], "host") ~= ARGV[2] then
+    return cjson.encode({status="error", code="not_lobby_host", err="Only the host can lock the lobby"})
+end
+
+-- Step 3: Update and publish
+local locked = ARGV[3] == "1"
+redis.call("HSET", KEYS[1], "locked", locked and 1 or 0)
+-- See create_lobby.lua for the channel naming scheme
+local events_channel = redis.call("HGET", KEYS[1], "events_channel") or (KEYS[1] .. ":events")
+redis.call("PUBLISH", events_channel, cjson.encode({
+    type = "lobby_updated",
+    lobby_id = ARGV[1],
+    locked = locked
+}))
+
+-- Step 4: Return success
+return cjson.encode({
+    status = "ok",
+    lobby_id = ARGV[1],
+    locked = locked
+})
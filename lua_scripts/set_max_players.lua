@@ -0,0 +1,45 @@
+-- KEYS:
+--   KEYS[1] = "lobby:<lobbyId>"
+--   KEYS[2] = "lobby:<lobbyId>:players"
+
+-- ARGV:
+--   ARGV[1] = lobbyId
+--   ARGV[2] = hostPlayerId (caller)
+--   ARGV[3] = maxPlayers
+
+-- Step 1: Check lobby exists
+if redis.call("EXISTS", KEYS[1]) == 0 then
+    return cjson.encode({status="error", code="lobby_not_found", err="Lobby does not exist"})
+end
+
+-- Step 2: Check caller is the host
+if redis.call("HGET", KEYS[1], "host") ~= ARGV[2] then
+    return cjson.encode({status="error", code="not_lobby_host", err="Only the host can change max players"})
+end
+
+-- Step 3: Validate the new limit
+local maxPlayers = tonumber(ARGV[3])
+if maxPlayers == nil or maxPlayers < 1 then
+    return cjson.encode({status="error", code="invalid_args", err="max players must be a positive number"})
+end
+local numPlayers = tonumber(redis.call("HLEN", KEYS[2]))
+if maxPlayers < numPlayers then
+    return cjson.encode({status="error", code="invalid_args", err="max players below current player count"})
+end
+
+-- Step 4: Update and publish
+redis.call("HSET", KEYS[1], "max_players", maxPlayers)
+-- See create_lobby.lua for the channel naming scheme
+local events_channel = redis.call("HGET", KEYS[1], "events_channel") or (KEYS[1] .. ":events")
+redis.call("PUBLISH", events_channel, cjson.encode({
+    type = "lobby_updated",
+    lobby_id = ARGV[1],
+    max_players = maxPlayers
+}))
+
+-- Step 5: Return success
+return cjson.encode({
+    status = "ok",
+    lobby_id = ARGV[1],
+    max_players = maxPlayers
+})
@@ -0,0 +1,18 @@
+-- KEYS:
+--   KEYS[1] = "lobby:<lobbyId>"
+--   KEYS[2] = "lobby:<lobbyId>:inputs"
+--   KEYS[3] = "lobby:<lobbyId>:tick_owner"
+
+-- ARGV:
+--   ARGV[1] = token of the node holding the tick lock
+--   ARGV[2] = tick number
+--   ARGV[3] = number of inputs the tick took
+
+-- Ends a tick that tick_inputs started and the tick handler ran, unless
+-- the tick script committed it already; see commit_tick.
+
+local done, err = commit_tick(KEYS[1], KEYS[2], KEYS[3], ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3]))
+if err then
+    return cjson.encode({status="error", code=err, err="Lobby is ticked by another node"})
+end
+return cjson.encode({status = "ok", committed = done})
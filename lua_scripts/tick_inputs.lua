@@ -0,0 +1,28 @@
+-- KEYS:
+--   KEYS[1] = "lobby:<lobbyId>"
+--   KEYS[2] = "lobby:<lobbyId>:inputs"
+--   KEYS[3] = "lobby:<lobbyId>:tick_owner"
+
+-- ARGV:
+--   ARGV[1] = token of the node holding the tick lock
+
+-- Starts a tick: returns every queued input with the lobby's next tick
+-- number, which survives a change of the ticking node. The inputs stay
+-- queued until tick_done, or the tick script, commits the tick.
+
+-- Step 1: Check lobby exists
+if redis.call("EXISTS", KEYS[1]) == 0 then
+    return cjson.encode({status="error", code="lobby_not_found", err="Lobby does not exist"})
+end
+
+-- Step 2: Check the caller still holds the lock
+if redis.call("GET", KEYS[3]) ~= ARGV[1] then
+    return cjson.encode({status="error", code="not_tick_owner", err="Lobby is ticked by another node"})
+end
+
+-- Step 3: Return the inputs, oldest first, with the tick number
+return cjson.encode({
+    status = "ok",
+    tick = (tonumber(redis.call("HGET", KEYS[1], "tick")) or 0) + 1,
+    inputs = redis.call("LRANGE", KEYS[2], 0, -1)
+})
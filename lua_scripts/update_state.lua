@@ -1,38 +1,165 @@
+-- manifest:
+-- {
+--   "access": "client",
+--   "args": [
+--     {"name": "lobby_id", "type": "string"},
+--     {"name": "state", "type": "json"},
+--     {"name": "expected_version", "type": "integer", "optional": true},
+--     {"name": "mode", "type": "string", "optional": true}
+--   ],
+--   "keys": ["lobby:{lobby_id}", "lobby:{lobby_id}:players", "lobby:{lobby_id}:versions"],
+--   "argv": ["{lobby_id}", "{player_id}", "{state}", "{expected_version}", "{mode}"]
+-- }
+
 -- KEYS:
 --   KEYS[1] = "lobby:<lobbyId>"
 --   KEYS[2] = "lobby:<lobbyId>:players"
+--   KEYS[3] = "lobby:<lobbyId>:versions"
 
 -- ARGV:
 --   ARGV[1] = lobbyId
 --   ARGV[2] = playerId
---   ARGV[3] = playerStateJson (e.g. {"health":80,"x":5,"y":6})
+--   ARGV[3] = playerStateJson (e.g. {"health":80,"x":5,"y":6}), or the
+--             change to apply to it, depending on ARGV[5]
+--   ARGV[4] = expectedVersion (optional; the update only applies if the
+--             player's state is still at this version)
+--   ARGV[5] = mode (optional):
+--             "replace" (default)  ARGV[3] is the new state
+--             "merge"              ARGV[3] is a JSON merge patch (RFC 7386),
+--                                  e.g. {"x":6,"shield":null}
+--             "set"                ARGV[3] is a list of path operations, e.g.
+--                                  [{"op":"set","path":"pos.x","value":6},
+--                                   {"op":"unset","path":"shield"}]
+
+local function invalid(msg)
+    return cjson.encode({status="error", code="invalid_args", err=msg})
+end
+
+-- decode, encode and merge_patch come from the prelude every script gets;
+-- see scriptLib in internal/db.
+
+-- apply_ops returns the state with ops applied, or nil and an error.
+local function apply_ops(state, ops)
+    if ops == EMPTY_ARRAY then
+        return state
+    end
+    if type(ops) ~= "table" or (next(ops) ~= nil and ops[1] == nil) then
+        return nil, "set mode expects a list of operations"
+    end
+    if not is_object(state) then
+        state = {}
+    end
+    for i, op in ipairs(ops) do
+        if type(op) ~= "table" or type(op.path) ~= "string" or op.path == "" then
+            return nil, "operation " .. i .. " needs a path"
+        end
+        local parts = {}
+        for part in string.gmatch(op.path, "[^.]+") do
+            parts[#parts + 1] = part
+        end
+        local node = state
+        for j = 1, #parts - 1 do
+            local child = node[parts[j]]
+            if child == EMPTY_ARRAY or (type(child) == "table" and not is_object(child)) then
+                return nil, "operation " .. i .. ": " .. parts[j] .. " is an array"
+            end
+            if not is_object(child) then
+                if op.op == "unset" then
+                    node = nil
+                    break
+                end
+                node[parts[j]] = {}
+            end
+            node = node[parts[j]]
+        end
+        local leaf = parts[#parts]
+        if op.op == "set" then
+            if op.value == nil then
+                return nil, "operation " .. i .. " needs a value"
+            end
+            node[leaf] = op.value
+        elseif op.op == "unset" then
+            if node then
+                node[leaf] = nil
+            end
+        else
+            return nil, "operation " .. i .. " must be set or unset"
+        end
+    end
+    return state
+end
 
 -- Step 1: Check lobby exists
 if redis.call("EXISTS", KEYS[1]) == 0 then
-    return cjson.encode({status="error", err="Lobby does not exist"})
+    return cjson.encode({status="error", code="lobby_not_found", err="Lobby does not exist"})
 end
 
 -- Step 2: Check player is in the lobby
 if redis.call("HEXISTS", KEYS[2], ARGV[2]) == 0 then
-    return cjson.encode({status="error", err="Player not in lobby"})
+    return cjson.encode({status="error", code="not_in_lobby", err="Player not in lobby"})
 end
 
--- Step 3: Update player state
-redis.call("HSET", KEYS[2], ARGV[2], ARGV[3])
+-- Step 3: Check the version the client based its update on
+-- Players who joined before versioning are at version 0
+local current = tonumber(redis.call("HGET", KEYS[3], ARGV[2])) or 0
+if ARGV[4] ~= "" and tonumber(ARGV[4]) ~= current then
+    return cjson.encode({
+        status = "error",
+        code = "version_conflict",
+        err = "State was updated concurrently",
+        details = {
+            version = current,
+            state = redis.call("HGET", KEYS[2], ARGV[2])
+        }
+    })
+end
 
--- Step 4: Publish to state channel
-local state_channel = "lobby:" .. ARGV[1] .. ":events"
-local evt = cjson.encode({
+-- Step 4: Work out the new state; the event only carries the change
+local mode = ARGV[5] ~= "" and ARGV[5] or "replace"
+local state = ARGV[3]
+local evt = {
     type = "player_state_update",
     lobby_id = ARGV[1],
-    player_id = ARGV[2],
-    state = ARGV[3]
-})
-redis.call("PUBLISH", state_channel, evt)
+    player_id = ARGV[2]
+}
+if mode == "replace" then
+    evt.state = ARGV[3]
+elseif mode == "merge" or mode == "set" then
+    local change = decode(ARGV[3], mode == "merge")
+    local ok, old = pcall(decode, redis.call("HGET", KEYS[2], ARGV[2]))
+    if not ok then
+        old = {}
+    end
+    local new, err
+    if mode == "merge" then
+        new = merge_patch(old, change)
+        evt.patch = ARGV[3]
+    else
+        new, err = apply_ops(old, change)
+        if err then
+            return invalid(err)
+        end
+        evt.ops = ARGV[3]
+    end
+    state = encode(new)
+else
+    return invalid("mode must be replace, merge or set")
+end
+
+-- Step 5: Update player state and bump its version
+redis.call("HSET", KEYS[2], ARGV[2], state)
+local version = redis.call("HINCRBY", KEYS[3], ARGV[2], 1)
 
--- Step 5: Success response
+-- Step 6: Publish to the lobby's events channel
+-- See create_lobby.lua for the channel naming scheme
+local events_channel = redis.call("HGET", KEYS[1], "events_channel") or (KEYS[1] .. ":events")
+evt.version = version
+redis.call("PUBLISH", events_channel, cjson.encode(evt))
+
+-- Step 7: Success response
 return cjson.encode({
     status = "ok",
     lobby_id = ARGV[1],
-    player_id = ARGV[2]
+    player_id = ARGV[2],
+    version = version
 })
@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"go-server/internal/auth"
 	DB "go-server/internal/db"
@@ -33,7 +34,11 @@ func main() {
 
 	// Init Redis
 	log.Println("Connecting to Redis...")
-	rm, err := DB.InitRedis(RedisAddr, RedisPassword, RedisLuaScriptPath)
+	rm, err := DB.InitRedis(RedisAddr, RedisPassword, RedisLuaScriptPath, DB.EventBacklog{
+		Size:    EventBacklogSize,
+		TTL:     EventBacklogTTL,
+		Streams: EventStreams,
+	})
 	if err != nil {
 		log.Fatal("Error connecting to Redis:", err)
 	}
@@ -47,10 +52,39 @@ func main() {
 	http.HandleFunc("/login", auth.LoginHandler(authProvider))
 	http.HandleFunc("/guest", auth.GuestHandler(rm.Client))
 	// WebSocket route
-	log.Println("WSServer listening on", WSAddr)
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		server.ServeWS(rm, w, r, authProvider)
+	policy, err := server.LoadChannelPolicy(ChannelPolicyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No channel policy at %s, using default", ChannelPolicyPath)
+		policy = server.DefaultChannelPolicy()
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	queuePolicy, err := server.ParseOverflowPolicy(WSSendQueuePolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tickHandler server.TickHandler
+	if LobbyTickScript != "" {
+		tickHandler = server.LuaTickHandler(LobbyTickScript)
+	}
+	wsServer := server.NewServer(context.Background(), rm, authProvider, server.Config{
+		ChannelPolicy: policy,
+		PingInterval:  WSPingInterval,
+		PingTimeout:   WSPingTimeout,
+		IdleTimeout:   WSIdleTimeout,
+
+		SendQueueLimit:  WSSendQueueLimit,
+		SendQueuePolicy: queuePolicy,
+
+		MaxBatchSize:   WSMaxBatchSize,
+		IdempotencyTTL: WSIdempotencyTTL,
+		ResumeTTL:      WSResumeTTL,
+
+		TickHandler: tickHandler,
+		TickRate:    LobbyTickRate,
 	})
+	log.Println("WSServer listening on", WSAddr)
+	http.HandleFunc("/ws", wsServer.ServeWS)
 
 	// Start server
 	srv := &http.Server{Addr: WSAddr}
@@ -65,10 +99,15 @@ func main() {
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	<-sig
 	log.Println("Shutting down Server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	rm.Shutdown(ctx, true) // Shutdown Redis listeners
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
 	defer cancel()
+	// Stop new upgrades and drain WebSocket clients first; http.Server does
+	// not track hijacked connections.
+	if err := wsServer.Shutdown(ctx, ReconnectAfter); err != nil {
+		log.Println("WebSocket shutdown:", err)
+	}
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Shutdown:", err)
+		log.Println("Shutdown:", err)
 	}
+	rm.Shutdown(ctx, RedisFlushOnShutdown) // Only wipes Redis when explicitly configured
 }